@@ -4,13 +4,18 @@ package main
 
 import (
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/stanleydv12/ginx/internal/config"
+	"github.com/stanleydv12/ginx/internal/errorpage"
+	"github.com/stanleydv12/ginx/internal/healthcheck"
 	"github.com/stanleydv12/ginx/internal/parser"
 	"github.com/stanleydv12/ginx/internal/socket/linux"
-	"github.com/stanleydv12/ginx/internal/async/epoll"
 	"github.com/stanleydv12/ginx/internal/server"
 	"github.com/stanleydv12/ginx/internal/loadbalancer"
+	"github.com/stanleydv12/ginx/internal/resolver"
+	"github.com/stanleydv12/ginx/internal/router"
 	"github.com/stanleydv12/ginx/pkg/logger"
 )
 
@@ -27,30 +32,85 @@ func main() {
 	}
 
 	logger.Info("Config loaded successfully",
-		"port", cfg.Server.Port,
 		"async_method", cfg.Server.AsyncMethod,
 		"load_balancer", cfg.Server.LoadBalancer,
-		"upstream_servers", cfg.Server.UpstreamServers,
+		"virtual_hosts", len(cfg.Server.VirtualHosts),
+		"upstreams", len(cfg.Server.Upstreams),
+		"workers", cfg.Server.Workers,
 	)
 
 	// Initialize socket manager
 	socketManager := linux.NewLinuxSocketManager()
 
-	// Initialize epoll
-	ep := epoll.NewEpoll(cfg.Server.MaxOpenFiles)
-
 	// Initialize HTTP parser
 	httpParser := parser.NewHTTPParser()
 
-	// Initialize load balancer
-	loadBalancer, err := loadbalancer.NewLoadBalancer(cfg)
+	// Initialize every upstream group: its servers, health checks and load
+	// balancer
+	upstreams := loadbalancer.NewRegistry()
+	healthCheckers := make(map[string]healthcheck.HealthCheckHandler, len(cfg.Server.Upstreams))
+	resolvers := make(map[string]resolver.ResolverHandler, len(cfg.Server.Upstreams))
+	for name, group := range cfg.Server.Upstreams {
+		resolvers[name], err = resolver.NewResolver(cfg.Server.Resolver, group.UpstreamServers)
+		if err != nil {
+			logger.Error("Failed to initialize upstream servers", "upstream", name, "error", err)
+			os.Exit(1)
+		}
+		upstreamServers := resolvers[name].Servers()
+
+		healthCheckers[name] = healthcheck.NewHealthChecker(*group.HealthCheck, upstreamServers)
+
+		loadBalancer, err := loadbalancer.NewLoadBalancer(group.LoadBalancer, group.HashKey, upstreamServers, healthCheckers[name])
+		if err != nil {
+			logger.Error("Failed to initialize load balancer", "upstream", name, "error", err)
+			os.Exit(1)
+		}
+		if err := upstreams.Register(name, loadBalancer); err != nil {
+			logger.Error("Failed to register load balancer", "upstream", name, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Initialize the router of every virtual host
+	virtualHosts := make([]*server.VirtualHost, len(cfg.Server.VirtualHosts))
+	for i, vhost := range cfg.Server.VirtualHosts {
+		locationRouter, err := router.NewRouter(vhost.Locations)
+		if err != nil {
+			logger.Error("Failed to initialize locations", "virtual_host", vhost.Name(), "error", err)
+			os.Exit(1)
+		}
+		virtualHosts[i] = &server.VirtualHost{Config: vhost, Router: locationRouter}
+	}
+
+	// Initialize error pages
+	errorPages, err := errorpage.NewErrorPages(cfg.Server.ErrorPages)
 	if err != nil {
-		logger.Error("Failed to initialize load balancer", "error", err)
+		logger.Error("Failed to initialize error pages", "error", err)
 		os.Exit(1)
 	}
 
 	// Initialize server
-	server := server.NewServer(*cfg, socketManager, ep, httpParser, loadBalancer)
+	server := server.NewServer(*cfg, socketManager, httpParser, virtualHosts, upstreams, healthCheckers, errorPages)
+
+	// Start re-resolving upstream host names and health checks
+	for name, upstreamResolver := range resolvers {
+		loadBalancer, _ := upstreams.Get(name)
+		upstreamResolver.Start(loadBalancer, healthCheckers[name])
+		defer upstreamResolver.Stop()
+
+		healthCheckers[name].Start()
+		defer healthCheckers[name].Stop()
+	}
+
+	// Stop on SIGINT and SIGTERM rather than dying, so the server gets to
+	// clean up after itself
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		logger.Info("Shutting down", "signal", sig.String())
+		server.Stop()
+	}()
 
 	// Start server
 	if err := server.Start(); err != nil {
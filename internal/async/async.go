@@ -0,0 +1,64 @@
+//go:build linux
+
+// Package async selects the backend the server's event loops run on: epoll,
+// which reports readiness for the loop's own system calls, or io_uring, which
+// performs the socket I/O itself and reports its completions.
+package async
+
+import (
+	"fmt"
+
+	"github.com/stanleydv12/ginx/internal/async/epoll"
+	"github.com/stanleydv12/ginx/internal/async/iouring"
+	"github.com/stanleydv12/ginx/internal/config"
+	"github.com/stanleydv12/ginx/pkg/logger"
+
+	"golang.org/x/sys/unix"
+)
+
+// Poller is what an event loop needs from a backend: register fds for
+// EPOLL* events, wait for them, and do the socket I/O they announce. Both
+// epoll and io_uring implement it with edge-triggered semantics when EPOLLET
+// is requested.
+type Poller interface {
+	Add(fd int, events uint32) error
+	// Remove stops watching fd, which must happen before it is closed.
+	Remove(fd int) error
+	Modify(fd int, events uint32) error
+	Wait(timeout int) ([]unix.EpollEvent, error)
+	Close() error
+
+	// Accept, Read, Write and Connect behave like the non-blocking system
+	// calls: when they cannot make progress yet they fail with EAGAIN, or
+	// EINPROGRESS for Connect, and an event for fd follows once they can.
+	// Accept returns a non-blocking socket.
+	Accept(fd int) (int, unix.Sockaddr, error)
+	Read(fd int, buf []byte) (int, error)
+	Write(fd int, buf []byte) (int, error)
+	Connect(fd int, sa unix.Sockaddr) error
+	// SocketError returns the error pending on fd, such as the outcome of a
+	// failed connect.
+	SocketError(fd int) error
+}
+
+// NewPoller creates the backend named by server.async_method. io_uring falls
+// back to epoll when the kernel does not support it or has it disabled.
+func NewPoller(method string, maxEvents int) (Poller, error) {
+	switch method {
+	case config.AsyncMethodIOUring:
+		poller, err := iouring.NewPoller(maxEvents)
+		if err == nil {
+			return poller, nil
+		}
+		logger.Info("io_uring is not available, falling back to epoll", "error", err)
+	case config.AsyncMethodEpoll:
+	default:
+		return nil, fmt.Errorf("unknown async method %q", method)
+	}
+
+	ep := epoll.NewEpoll(maxEvents)
+	if ep == nil {
+		return nil, fmt.Errorf("failed to create epoll instance")
+	}
+	return ep, nil
+}
@@ -13,8 +13,13 @@ type EpollHandler interface {
 	Add(fd int, events uint32) error
 	Remove(fd int) error
 	Modify(fd int, events uint32) error
-	Wait() ([]unix.EpollEvent, error)
+	Wait(timeout int) ([]unix.EpollEvent, error)
 	Close() error
+	Accept(fd int) (int, unix.Sockaddr, error)
+	Read(fd int, buf []byte) (int, error)
+	Write(fd int, buf []byte) (int, error)
+	Connect(fd int, sa unix.Sockaddr) error
+	SocketError(fd int) error
 }
 
 type Epoll struct {
@@ -64,12 +69,14 @@ func (e *Epoll) Modify(fd int, events uint32) error {
 	})
 }
 
-func (e *Epoll) Wait() ([]unix.EpollEvent, error) {
+// Wait blocks until events are ready or timeout milliseconds elapse. A
+// negative timeout blocks indefinitely.
+func (e *Epoll) Wait(timeout int) ([]unix.EpollEvent, error) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
 	for {
-		n, err := unix.EpollWait(e.epfd, e.events, -1)
+		n, err := unix.EpollWait(e.epfd, e.events, timeout)
 		if err != nil {
 			// If the system call was interrupted, retry
 			if err == unix.EINTR {
@@ -84,3 +91,35 @@ func (e *Epoll) Wait() ([]unix.EpollEvent, error) {
 func (e *Epoll) Close() error {
 	return unix.Close(e.epfd)
 }
+
+// Accept, Read, Write and Connect are the plain non-blocking system calls;
+// epoll only tells when they can make progress.
+
+func (e *Epoll) Accept(fd int) (int, unix.Sockaddr, error) {
+	return unix.Accept4(fd, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+}
+
+func (e *Epoll) Read(fd int, buf []byte) (int, error) {
+	return unix.Read(fd, buf)
+}
+
+func (e *Epoll) Write(fd int, buf []byte) (int, error) {
+	return unix.Write(fd, buf)
+}
+
+func (e *Epoll) Connect(fd int, sa unix.Sockaddr) error {
+	return unix.Connect(fd, sa)
+}
+
+// SocketError returns the error the kernel has pending for fd, which is how a
+// failed non-blocking connect is reported.
+func (e *Epoll) SocketError(fd int) error {
+	errno, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return unix.Errno(errno)
+	}
+	return nil
+}
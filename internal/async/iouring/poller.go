@@ -0,0 +1,622 @@
+//go:build linux
+
+package iouring
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// maxRingEntries caps the submission queue; a full queue is simply
+	// submitted early, so it does not need to match the number of fds.
+	maxRingEntries = 4096
+
+	// recvBufferSize is the most a single receive returns. Each socket
+	// receives into a buffer of its own, one receive at a time.
+	recvBufferSize = 16 * 1024
+
+	// maxSendSize caps how much of one Write is copied into a send.
+	maxSendSize = 64 * 1024
+
+	// orphanTimeout is how long a send may carry on once its fd has been
+	// removed, the way a closed socket still drains its buffer, before it
+	// is cancelled.
+	orphanTimeout = 60 * time.Second
+
+	// timeoutUserData and cancelUserData tag the poller's own timeout and
+	// cancel requests. Every other request carries the id of its operation,
+	// counting up from one, so it never collides with these.
+	timeoutUserData = ^uint64(0)
+	cancelUserData  = ^uint64(0) - 1
+)
+
+// operation is a request in flight. It keeps the memory the kernel reads or
+// writes reachable until the request completes, even after its fd has been
+// removed.
+type operation struct {
+	id     uint64
+	opcode uint8
+	fd     int
+	// socket receives the result. It is nil once the fd has been removed,
+	// and the result is then dropped.
+	socket *socketState
+	// orphaned is set on a send that outlived the removal of its fd, whose
+	// result means nothing to whichever socket has the fd now.
+	orphaned bool
+
+	buf     []byte
+	addr    unix.RawSockaddrAny
+	addrLen uint32
+	// timer is the id of the timeout that cancels an orphaned send; ts and
+	// target belong to that timeout.
+	timer  uint64
+	ts     Timespec
+	target uint64
+}
+
+// socketState is what the poller knows about a socket: the requests in flight
+// on it and the results the event loop has yet to collect.
+type socketState struct {
+	// events is the EPOLL* mask given to Add or Modify.
+	events     uint32
+	registered bool
+	listener   bool
+	// queued is set while the fd waits to be reported by the next Wait.
+	queued bool
+
+	// reading, writing and connecting are the ids of the receive or accept,
+	// the send and the connect in flight, or zero.
+	reading    uint64
+	writing    uint64
+	connecting uint64
+
+	// err is the socket's pending error. It fails every later Read and
+	// Write; a listener's accept error is returned once.
+	err error
+
+	buf      []byte
+	received []byte
+	eof      bool
+	sendBuf  []byte
+
+	// accepted is a connection accepted on a listener that Accept has not
+	// returned yet, or -1.
+	accepted int
+	peer     unix.Sockaddr
+}
+
+// Poller runs socket I/O on io_uring behind the readiness interface of
+// epoll. Accept, Read, Write and Connect submit the operation and report its
+// completion as an event, which the event loop answers by calling them again
+// to collect the result:
+//
+//   - A registered socket always has a receive in flight until it has
+//     something for Read to return, so EPOLLIN follows once data, EOF or an
+//     error arrives. A listener has an accept in flight in the same way.
+//   - Write copies what it is given into a send and returns, like write(2)
+//     filling the socket buffer. Later Writes return EAGAIN until the send
+//     has completed, which is reported as EPOLLOUT.
+//   - Connect returns EINPROGRESS, and the connect's completion is reported
+//     as EPOLLOUT, with EPOLLERR if it failed.
+//
+// Events are reported when something completes, and when Add or Modify asks
+// for an event that is already due, which gives the edge-triggered behaviour
+// the event loops expect whether or not EPOLLET is set.
+//
+// Remove cancels the receive, accept or connect in flight. A send is left to
+// finish, since the fd is usually removed just after the last bytes of a
+// response were written; orphanTimeout bounds how long it may take.
+type Poller struct {
+	ring    *Ring
+	sockets map[int]*socketState
+	ops     map[uint64]*operation
+	lastID  uint64
+	// orphans maps an fd to a send still in flight after the fd was removed.
+	// A socket that gets the same fd, which may be the same connection back
+	// from a pool, waits for it before sending.
+	orphans map[int]*operation
+	// ready lists the fds to report on the next Wait.
+	ready []int
+
+	completions []Completion
+	events      []unix.EpollEvent
+	maxEvents   int
+	timeout     Timespec
+}
+
+// NewPoller sets up an io_uring based poller returning at most maxEvents
+// events from each Wait. It fails if the kernel cannot run it, in which case
+// the caller should fall back to epoll.
+func NewPoller(maxEvents int) (*Poller, error) {
+	entries := uint32(maxRingEntries)
+	if maxEvents < maxRingEntries {
+		entries = uint32(maxEvents)
+	}
+
+	ring, err := NewRing(entries)
+	if err != nil {
+		return nil, err
+	}
+	if !ring.Supports(opTimeout, opAccept, opAsyncCancel, opConnect, opSend, opRecv) {
+		ring.Close()
+		return nil, ErrNotSupported
+	}
+
+	return &Poller{
+		ring:      ring,
+		sockets:   make(map[int]*socketState),
+		ops:       make(map[uint64]*operation),
+		orphans:   make(map[int]*operation),
+		events:    make([]unix.EpollEvent, 0, maxEvents),
+		maxEvents: maxEvents,
+	}, nil
+}
+
+func (p *Poller) Add(fd int, events uint32) error {
+	s, exists := p.sockets[fd]
+	if exists && s.registered {
+		return unix.EEXIST
+	}
+	if !exists {
+		// Sockets from Accept and Connect are known already; anything
+		// else is a listener or a connection back from a pool.
+		listening, _ := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ACCEPTCONN)
+		s = p.newSocket(fd, listening == 1)
+	}
+
+	if err := p.register(fd, s, events); err != nil {
+		p.Remove(fd)
+		return err
+	}
+	return nil
+}
+
+// Remove forgets fd, cancelling what is in flight on it. Everything queued
+// for fd is submitted before Remove returns, so the fd can be closed and its
+// number reused without a request reaching the wrong socket.
+func (p *Poller) Remove(fd int) error {
+	s, exists := p.sockets[fd]
+	if !exists {
+		return unix.ENOENT
+	}
+	delete(p.sockets, fd)
+
+	for _, id := range []uint64{s.reading, s.connecting} {
+		if id != 0 {
+			p.cancel(id)
+		}
+	}
+	if s.writing != 0 {
+		p.orphan(fd, s.writing)
+	}
+	if s.accepted >= 0 {
+		unix.Close(s.accepted)
+	}
+
+	_, err := p.ring.Submit()
+	return err
+}
+
+func (p *Poller) Modify(fd int, events uint32) error {
+	s, exists := p.sockets[fd]
+	if !exists || !s.registered {
+		return unix.ENOENT
+	}
+	return p.register(fd, s, events)
+}
+
+// register sets the events fd is watched for and starts receiving or
+// accepting if they include EPOLLIN.
+func (p *Poller) register(fd int, s *socketState, events uint32) error {
+	s.events = events
+	s.registered = true
+	p.queue(fd, s)
+
+	if events&unix.EPOLLIN == 0 {
+		return nil
+	}
+	if s.listener {
+		return p.acceptNext(fd, s)
+	}
+	return p.receive(fd, s)
+}
+
+// Accept returns a connection accepted on the listener fd, as a non-blocking
+// socket, or EAGAIN until the accept in flight completes.
+func (p *Poller) Accept(fd int) (int, unix.Sockaddr, error) {
+	s, exists := p.sockets[fd]
+	if !exists {
+		s = p.newSocket(fd, true)
+	}
+
+	if s.accepted >= 0 {
+		connFd, peer := s.accepted, s.peer
+		s.accepted, s.peer = -1, nil
+		p.newSocket(connFd, false)
+		if err := p.acceptNext(fd, s); err != nil {
+			s.err = err
+			p.queue(fd, s)
+		}
+		return connFd, peer, nil
+	}
+
+	if err := s.err; err != nil {
+		s.err = nil
+		return -1, nil, err
+	}
+	if err := p.acceptNext(fd, s); err != nil {
+		return -1, nil, err
+	}
+	return -1, nil, unix.EAGAIN
+}
+
+// acceptNext submits an accept on a listener unless one is in flight or its
+// result has not been collected.
+func (p *Poller) acceptNext(fd int, s *socketState) error {
+	if s.reading != 0 || s.accepted >= 0 || s.err != nil {
+		return nil
+	}
+
+	op := p.newOperation(opAccept, fd, s)
+	op.addrLen = unix.SizeofSockaddrAny
+	if err := p.ring.PrepareAccept(fd, &op.addr, &op.addrLen, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, op.id); err != nil {
+		delete(p.ops, op.id)
+		return err
+	}
+	s.reading = op.id
+	return nil
+}
+
+// Read returns what the last receive on fd brought in, 0 at EOF, or EAGAIN
+// until the receive in flight completes.
+func (p *Poller) Read(fd int, buf []byte) (int, error) {
+	s := p.socket(fd)
+
+	if len(s.received) > 0 {
+		n := copy(buf, s.received)
+		s.received = s.received[n:]
+		if len(s.received) == 0 && s.events&unix.EPOLLIN != 0 {
+			if err := p.receive(fd, s); err != nil {
+				s.err = err
+				p.queue(fd, s)
+			}
+		}
+		return n, nil
+	}
+
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.eof {
+		return 0, nil
+	}
+	if err := p.receive(fd, s); err != nil {
+		return 0, err
+	}
+	return 0, unix.EAGAIN
+}
+
+// receive submits a receive on fd unless one is in flight, fd is still
+// connecting, or Read has something left to return.
+func (p *Poller) receive(fd int, s *socketState) error {
+	if s.reading != 0 || s.connecting != 0 || len(s.received) > 0 || s.eof || s.err != nil {
+		return nil
+	}
+
+	if s.buf == nil {
+		s.buf = make([]byte, recvBufferSize)
+	}
+	op := p.newOperation(opRecv, fd, s)
+	op.buf = s.buf
+	if err := p.ring.PrepareRecv(fd, op.buf, op.id); err != nil {
+		delete(p.ops, op.id)
+		return err
+	}
+	s.reading = op.id
+	return nil
+}
+
+// Write submits a send of up to maxSendSize bytes of buf and returns how many
+// it took, or EAGAIN while the previous send is still in flight.
+func (p *Poller) Write(fd int, buf []byte) (int, error) {
+	s := p.socket(fd)
+
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.writing != 0 || s.connecting != 0 {
+		return 0, unix.EAGAIN
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	n := min(len(buf), maxSendSize)
+	s.sendBuf = append(s.sendBuf[:0], buf[:n]...)
+	op := p.newOperation(opSend, fd, s)
+	op.buf = s.sendBuf
+	if err := p.send(op); err != nil {
+		return 0, err
+	}
+	s.writing = op.id
+	return n, nil
+}
+
+// send submits op.buf. MSG_WAITALL has the kernel keep going until all of it
+// is sent, rather than completing after part of it.
+func (p *Poller) send(op *operation) error {
+	if err := p.ring.PrepareSend(op.fd, op.buf, unix.MSG_NOSIGNAL|unix.MSG_WAITALL, op.id); err != nil {
+		delete(p.ops, op.id)
+		return err
+	}
+	return nil
+}
+
+// Connect submits a connect of fd to sa and returns EINPROGRESS.
+func (p *Poller) Connect(fd int, sa unix.Sockaddr) error {
+	s := p.socket(fd)
+
+	op := p.newOperation(opConnect, fd, s)
+	length, err := putSockaddr(&op.addr, sa)
+	if err == nil {
+		err = p.ring.PrepareConnect(fd, unsafe.Pointer(&op.addr), length, op.id)
+	}
+	if err != nil {
+		delete(p.ops, op.id)
+		return err
+	}
+	s.connecting = op.id
+	return unix.EINPROGRESS
+}
+
+// SocketError returns the error an operation on fd failed with, or else the
+// error the kernel has pending for it.
+func (p *Poller) SocketError(fd int) error {
+	if s, exists := p.sockets[fd]; exists && s.err != nil {
+		return s.err
+	}
+
+	errno, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return unix.Errno(errno)
+	}
+	return nil
+}
+
+// Wait submits the queued requests and blocks until events are ready or
+// timeout milliseconds elapse. A negative timeout blocks indefinitely.
+func (p *Poller) Wait(timeout int) ([]unix.EpollEvent, error) {
+	var waitNr uint32
+	if len(p.ready) == 0 && p.ring.Ready() == 0 && timeout != 0 {
+		waitNr = 1
+		if timeout > 0 {
+			// A timeout with a count of one also completes as soon as any
+			// other request does, so it never outlives this Wait.
+			p.timeout = Timespec{Sec: int64(timeout / 1000), Nsec: int64(timeout%1000) * 1e6}
+			if err := p.ring.PrepareTimeout(&p.timeout, 1, timeoutUserData); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for {
+		_, err := p.ring.SubmitAndWait(waitNr)
+		if err != nil {
+			// If the system call was interrupted, retry
+			if err == unix.EINTR {
+				continue
+			}
+			return nil, err
+		}
+		break
+	}
+
+	p.completions = p.ring.Completions(p.completions[:0], p.maxEvents)
+	for _, c := range p.completions {
+		p.handleCompletion(c)
+	}
+
+	p.events = p.events[:0]
+	for _, fd := range p.ready {
+		s, exists := p.sockets[fd]
+		if !exists || !s.queued {
+			continue
+		}
+		s.queued = false
+		if events := s.readiness(); events != 0 {
+			p.events = append(p.events, unix.EpollEvent{Events: events, Fd: int32(fd)})
+		}
+	}
+	p.ready = p.ready[:0]
+	return p.events, nil
+}
+
+// handleCompletion stores the result of an operation on its socket and queues
+// the socket to be reported.
+func (p *Poller) handleCompletion(c Completion) {
+	op, exists := p.ops[c.UserData]
+	if !exists {
+		return
+	}
+	delete(p.ops, c.UserData)
+
+	if op.timer != 0 {
+		p.ring.PrepareCancel(op.timer, cancelUserData)
+	}
+	if op.opcode == opTimeout {
+		if target, exists := p.ops[op.target]; exists && target.socket == nil {
+			p.cancel(op.target)
+		}
+		return
+	}
+
+	s := op.socket
+	if s == nil {
+		if op.opcode == opAccept && c.Result >= 0 {
+			unix.Close(int(c.Result))
+		}
+		if p.orphans[op.fd] == op {
+			delete(p.orphans, op.fd)
+		}
+		return
+	}
+
+	var err error
+	if c.Result < 0 {
+		err = unix.Errno(-c.Result)
+	}
+
+	switch op.opcode {
+	case opAccept:
+		s.reading = 0
+		if err != nil {
+			s.err = err
+		} else {
+			s.accepted, s.peer = int(c.Result), sockaddr(&op.addr)
+		}
+	case opRecv:
+		s.reading = 0
+		switch {
+		case err != nil:
+			s.err = err
+		case c.Result == 0:
+			s.eof = true
+		default:
+			s.received = op.buf[:c.Result]
+		}
+	case opSend:
+		if op.orphaned {
+			// Whether or not the socket is the one the send was for, it
+			// may send again now.
+			s.writing = 0
+			break
+		}
+		if err == nil && int(c.Result) < len(op.buf) {
+			// Kernels without MSG_WAITALL for sends may still stop short.
+			op.buf = op.buf[c.Result:]
+			p.ops[op.id] = op
+			if err = p.send(op); err == nil {
+				return
+			}
+		}
+		s.writing = 0
+		if err != nil {
+			s.err = err
+		}
+	case opConnect:
+		s.connecting = 0
+		if err != nil {
+			s.err = err
+		} else if s.events&unix.EPOLLIN != 0 {
+			if err := p.receive(op.fd, s); err != nil {
+				s.err = err
+			}
+		}
+	}
+	p.queue(op.fd, s)
+}
+
+// readiness is the mask epoll would report for the socket now, limited to
+// the registered events.
+func (s *socketState) readiness() uint32 {
+	if !s.registered {
+		return 0
+	}
+	if s.listener {
+		if s.accepted >= 0 || s.err != nil {
+			return s.events & unix.EPOLLIN
+		}
+		return 0
+	}
+
+	var ready uint32
+	if s.err != nil {
+		ready |= unix.EPOLLERR
+	}
+	if len(s.received) > 0 || s.eof {
+		ready |= unix.EPOLLIN
+	}
+	if s.writing == 0 && s.connecting == 0 {
+		ready |= unix.EPOLLOUT
+	}
+	return ready & (s.events | unix.EPOLLERR)
+}
+
+func (p *Poller) queue(fd int, s *socketState) {
+	if !s.queued {
+		s.queued = true
+		p.ready = append(p.ready, fd)
+	}
+}
+
+// socket returns the state of fd, creating it for an fd the poller has not
+// seen yet.
+func (p *Poller) socket(fd int) *socketState {
+	if s, exists := p.sockets[fd]; exists {
+		return s
+	}
+	return p.newSocket(fd, false)
+}
+
+// newSocket starts tracking fd. If a send from an earlier socket with the
+// same fd is still in flight, the new socket's sends wait for it.
+func (p *Poller) newSocket(fd int, listener bool) *socketState {
+	s := &socketState{listener: listener, accepted: -1}
+	if op, exists := p.orphans[fd]; exists {
+		delete(p.orphans, fd)
+		op.socket = s
+		s.writing = op.id
+	}
+	p.sockets[fd] = s
+	return s
+}
+
+func (p *Poller) newOperation(opcode uint8, fd int, s *socketState) *operation {
+	p.lastID++
+	op := &operation{id: p.lastID, opcode: opcode, fd: fd, socket: s}
+	p.ops[op.id] = op
+	return op
+}
+
+// cancel detaches the operation id from its socket and cancels it.
+func (p *Poller) cancel(id uint64) {
+	if op, exists := p.ops[id]; exists {
+		op.socket = nil
+	}
+	p.ring.PrepareCancel(id, cancelUserData)
+}
+
+// orphan detaches the send id from the removed fd and lets it run for up to
+// orphanTimeout.
+func (p *Poller) orphan(fd int, id uint64) {
+	op, exists := p.ops[id]
+	if !exists {
+		return
+	}
+	op.socket = nil
+	op.orphaned = true
+	p.orphans[fd] = op
+
+	if op.timer != 0 {
+		p.ring.PrepareCancel(op.timer, cancelUserData)
+		op.timer = 0
+	}
+	timer := p.newOperation(opTimeout, fd, nil)
+	timer.target = id
+	timer.ts = Timespec{Sec: int64(orphanTimeout / time.Second)}
+	if err := p.ring.PrepareTimeout(&timer.ts, 0, timer.id); err != nil {
+		delete(p.ops, timer.id)
+		return
+	}
+	op.timer = timer.id
+}
+
+func (p *Poller) Close() error {
+	return p.ring.Close()
+}
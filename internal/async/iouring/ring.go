@@ -0,0 +1,403 @@
+//go:build linux
+
+// Package iouring is a minimal io_uring binding built directly on the
+// io_uring_setup, io_uring_enter and io_uring_register system calls.
+//
+// Ring exposes the submission and completion queues with helpers for the
+// accept, connect, send, receive, cancel and timeout operations. Poller runs
+// the server's socket I/O through them: every accept, read, write and connect
+// is submitted to the ring, and its completion is turned into the EPOLL*
+// event the event loops wait for, so the same loop runs on epoll or io_uring.
+package iouring
+
+import (
+	"errors"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Opcodes, setup flags and feature bits from <linux/io_uring.h>.
+const (
+	opTimeout     = 11
+	opAccept      = 13
+	opAsyncCancel = 14
+	opConnect     = 16
+	opSend        = 26
+	opRecv        = 27
+
+	setupClamp = 1 << 4
+
+	featSingleMmap = 1 << 0
+	featNoDrop     = 1 << 1
+	// featFastPoll lets a socket operation that cannot complete yet wait on
+	// the socket instead of blocking a kernel worker thread.
+	featFastPoll = 1 << 5
+
+	sqCQOverflow = 1 << 1
+
+	enterGetEvents = 1 << 0
+
+	offSQRing = 0
+	offCQRing = 0x8000000
+	offSQEs   = 0x10000000
+
+	registerProbe  = 8
+	opSupported    = 1 << 0
+	probeOpsLength = 256
+)
+
+// ErrNotSupported is returned by NewRing when the kernel's io_uring lacks a
+// feature this package relies on.
+var ErrNotSupported = errors.New("io_uring: kernel does not support the required features")
+
+// ErrQueueFull is returned when no submission queue entry is free even after
+// submitting everything that was queued.
+var ErrQueueFull = errors.New("io_uring: submission queue is full")
+
+type sqRingOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type cqRingOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type params struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        sqRingOffsets
+	cqOff        cqRingOffsets
+}
+
+// sqe is a submission queue entry, struct io_uring_sqe.
+type sqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// cqe is a completion queue entry, struct io_uring_cqe.
+type cqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// Timespec is struct __kernel_timespec, which is 64-bit on every platform.
+type Timespec struct {
+	Sec  int64
+	Nsec int64
+}
+
+type probeOp struct {
+	op    uint8
+	resv  uint8
+	flags uint16
+	resv2 uint32
+}
+
+type probe struct {
+	lastOp uint8
+	opsLen uint8
+	resv   uint16
+	resv2  [3]uint32
+	ops    [probeOpsLength]probeOp
+}
+
+// Completion is a reaped completion queue entry.
+type Completion struct {
+	// UserData is the value the request was submitted with.
+	UserData uint64
+	// Result is the operation's return value, or a negated errno.
+	Result int32
+	// Flags holds the IORING_CQE_F_* bits.
+	Flags uint32
+}
+
+// Ring is one io_uring instance. It is not safe for concurrent use.
+type Ring struct {
+	fd int
+
+	sqRing []byte
+	cqRing []byte
+	sqeMem []byte
+
+	sqHead  *uint32
+	sqTail  *uint32
+	sqFlags *uint32
+	sqMask  uint32
+	sqArray []uint32
+	sqes    []sqe
+	// sqeTail counts the entries handed out, some of which the kernel has
+	// not been told about yet.
+	sqeTail uint32
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []cqe
+}
+
+// NewRing sets up an io_uring with room for at least entries submissions.
+// It fails with ErrNotSupported, or the errno from io_uring_setup such as
+// ENOSYS or EPERM, when io_uring cannot be used.
+func NewRing(entries uint32) (*Ring, error) {
+	var p params
+	p.flags = setupClamp
+
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+
+	r := &Ring{fd: int(fd)}
+	if p.features&(featSingleMmap|featNoDrop|featFastPoll) != featSingleMmap|featNoDrop|featFastPoll {
+		r.Close()
+		return nil, ErrNotSupported
+	}
+	if err := r.mmap(&p); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Ring) mmap(p *params) error {
+	size := p.sqOff.array + p.sqEntries*4
+	if cqSize := p.cqOff.cqes + p.cqEntries*uint32(unsafe.Sizeof(cqe{})); cqSize > size {
+		size = cqSize
+	}
+
+	// With IORING_FEAT_SINGLE_MMAP both rings live in one mapping.
+	ring, err := unix.Mmap(r.fd, offSQRing, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return err
+	}
+	r.sqRing = ring
+	r.cqRing = ring
+
+	sqeMem, err := unix.Mmap(r.fd, offSQEs, int(p.sqEntries)*int(unsafe.Sizeof(sqe{})), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return err
+	}
+	r.sqeMem = sqeMem
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&ring[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&ring[p.sqOff.tail]))
+	r.sqFlags = (*uint32)(unsafe.Pointer(&ring[p.sqOff.flags]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&ring[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&ring[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*sqe)(unsafe.Pointer(&sqeMem[0])), p.sqEntries)
+	r.sqeTail = atomic.LoadUint32(r.sqTail)
+
+	r.cqHead = (*uint32)(unsafe.Pointer(&ring[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&ring[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&ring[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*cqe)(unsafe.Pointer(&ring[p.cqOff.cqes])), p.cqEntries)
+	return nil
+}
+
+// Supports reports whether the kernel implements every given opcode.
+func (r *Ring) Supports(opcodes ...uint8) bool {
+	var pr probe
+	_, _, errno := unix.Syscall6(unix.SYS_IO_URING_REGISTER, uintptr(r.fd), registerProbe, uintptr(unsafe.Pointer(&pr)), probeOpsLength, 0, 0)
+	if errno != 0 {
+		return false
+	}
+	for _, op := range opcodes {
+		if op > pr.lastOp || pr.ops[op].flags&opSupported == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// getSQE hands out the next free submission queue entry, submitting what is
+// queued first if the queue is full.
+func (r *Ring) getSQE() (*sqe, error) {
+	if r.sqeTail-atomic.LoadUint32(r.sqHead) > r.sqMask {
+		if _, err := r.Submit(); err != nil {
+			return nil, err
+		}
+		if r.sqeTail-atomic.LoadUint32(r.sqHead) > r.sqMask {
+			return nil, ErrQueueFull
+		}
+	}
+
+	index := r.sqeTail & r.sqMask
+	r.sqArray[index] = index
+	r.sqeTail++
+
+	entry := &r.sqes[index]
+	*entry = sqe{}
+	return entry, nil
+}
+
+func (r *Ring) prepare(opcode uint8, fd int, addr unsafe.Pointer, length uint32, off uint64, userData uint64) (*sqe, error) {
+	entry, err := r.getSQE()
+	if err != nil {
+		return nil, err
+	}
+	entry.opcode = opcode
+	entry.fd = int32(fd)
+	entry.addr = uint64(uintptr(addr))
+	entry.len = length
+	entry.off = off
+	entry.userData = userData
+	return entry, nil
+}
+
+// The buffers and addresses passed to the Prepare methods are read or written
+// by the kernel until the request completes, so the caller must keep them
+// reachable and leave them alone until then.
+
+// PrepareAccept queues an accept on the listening socket fd. The peer's
+// address is stored in addr, whose size addrLen holds and is updated to, and
+// the new socket gets flags, as with accept4. The result is the new fd.
+func (r *Ring) PrepareAccept(fd int, addr *unix.RawSockaddrAny, addrLen *uint32, flags uint32, userData uint64) error {
+	entry, err := r.prepare(opAccept, fd, unsafe.Pointer(addr), 0, uint64(uintptr(unsafe.Pointer(addrLen))), userData)
+	if err != nil {
+		return err
+	}
+	entry.opFlags = flags
+	return nil
+}
+
+// PrepareConnect queues a connect of fd to the addrLen bytes of raw socket
+// address at addr.
+func (r *Ring) PrepareConnect(fd int, addr unsafe.Pointer, addrLen uint32, userData uint64) error {
+	_, err := r.prepare(opConnect, fd, addr, 0, uint64(addrLen), userData)
+	return err
+}
+
+// PrepareSend queues a send of buf on fd with the given MSG_* flags. The
+// result is the number of bytes sent.
+func (r *Ring) PrepareSend(fd int, buf []byte, flags uint32, userData uint64) error {
+	entry, err := r.prepare(opSend, fd, unsafe.Pointer(&buf[0]), uint32(len(buf)), 0, userData)
+	if err != nil {
+		return err
+	}
+	entry.opFlags = flags
+	return nil
+}
+
+// PrepareRecv queues a receive on fd into buf. The result is the number of
+// bytes received, which is zero once the peer has shut down its side.
+func (r *Ring) PrepareRecv(fd int, buf []byte, userData uint64) error {
+	_, err := r.prepare(opRecv, fd, unsafe.Pointer(&buf[0]), uint32(len(buf)), 0, userData)
+	return err
+}
+
+// PrepareCancel queues the cancellation of the request submitted with target,
+// which then completes with -ECANCELED unless it has already finished.
+func (r *Ring) PrepareCancel(target, userData uint64) error {
+	entry, err := r.prepare(opAsyncCancel, -1, nil, 0, 0, userData)
+	if err != nil {
+		return err
+	}
+	entry.addr = target
+	return nil
+}
+
+// PrepareTimeout queues a timeout that completes with -ETIME once ts has
+// elapsed, or with 0 as soon as count other requests have completed. ts is
+// copied when the request is submitted.
+func (r *Ring) PrepareTimeout(ts *Timespec, count uint64, userData uint64) error {
+	_, err := r.prepare(opTimeout, -1, unsafe.Pointer(ts), 1, count, userData)
+	return err
+}
+
+// Submit tells the kernel about all queued entries without waiting for any
+// of them to complete.
+func (r *Ring) Submit() (int, error) {
+	return r.SubmitAndWait(0)
+}
+
+// SubmitAndWait submits all queued entries and waits until at least waitNr
+// completions are available.
+func (r *Ring) SubmitAndWait(waitNr uint32) (int, error) {
+	atomic.StoreUint32(r.sqTail, r.sqeTail)
+	pending := r.sqeTail - atomic.LoadUint32(r.sqHead)
+
+	// Completions that did not fit in the completion queue are held back
+	// by the kernel until it is entered with GETEVENTS.
+	var flags uintptr
+	if waitNr > 0 || atomic.LoadUint32(r.sqFlags)&sqCQOverflow != 0 {
+		flags = enterGetEvents
+	}
+	if pending == 0 && flags == 0 {
+		return 0, nil
+	}
+
+	n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(pending), uintptr(waitNr), flags, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// Ready returns the number of completions waiting to be reaped.
+func (r *Ring) Ready() uint32 {
+	return atomic.LoadUint32(r.cqTail) - atomic.LoadUint32(r.cqHead)
+}
+
+// Completions appends up to max available completions to dst and removes them
+// from the completion queue. It does not block.
+func (r *Ring) Completions(dst []Completion, max int) []Completion {
+	head := atomic.LoadUint32(r.cqHead)
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail && max > 0; head, max = head+1, max-1 {
+		entry := &r.cqes[head&r.cqMask]
+		dst = append(dst, Completion{UserData: entry.userData, Result: entry.res, Flags: entry.flags})
+	}
+	atomic.StoreUint32(r.cqHead, head)
+	return dst
+}
+
+// Close unmaps the rings and closes the io_uring file descriptor.
+func (r *Ring) Close() error {
+	if r.sqeMem != nil {
+		unix.Munmap(r.sqeMem)
+		r.sqeMem = nil
+	}
+	if r.sqRing != nil {
+		unix.Munmap(r.sqRing)
+		r.sqRing, r.cqRing = nil, nil
+	}
+	return unix.Close(r.fd)
+}
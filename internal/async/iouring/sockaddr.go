@@ -0,0 +1,89 @@
+//go:build linux
+
+package iouring
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// putSockaddr stores sa in raw in the kernel's layout and returns its length.
+// x/sys/unix does the same for its system calls but does not export it.
+func putSockaddr(raw *unix.RawSockaddrAny, sa unix.Sockaddr) (uint32, error) {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		addr := (*unix.RawSockaddrInet4)(unsafe.Pointer(raw))
+		addr.Family = unix.AF_INET
+		putPort(&addr.Port, sa.Port)
+		addr.Addr = sa.Addr
+		return unix.SizeofSockaddrInet4, nil
+	case *unix.SockaddrInet6:
+		addr := (*unix.RawSockaddrInet6)(unsafe.Pointer(raw))
+		addr.Family = unix.AF_INET6
+		putPort(&addr.Port, sa.Port)
+		addr.Addr = sa.Addr
+		addr.Scope_id = sa.ZoneId
+		return unix.SizeofSockaddrInet6, nil
+	case *unix.SockaddrUnix:
+		addr := (*unix.RawSockaddrUnix)(unsafe.Pointer(raw))
+		if len(sa.Name) >= len(addr.Path) {
+			return 0, unix.EINVAL
+		}
+		addr.Family = unix.AF_UNIX
+		for i := 0; i < len(sa.Name); i++ {
+			addr.Path[i] = int8(sa.Name[i])
+		}
+		// The length covers the terminating NUL, except for abstract
+		// sockets, whose name starts with "@" in place of a NUL.
+		length := uint32(2)
+		if len(sa.Name) > 0 {
+			length += uint32(len(sa.Name)) + 1
+		}
+		if addr.Path[0] == '@' {
+			addr.Path[0] = 0
+			length--
+		}
+		return length, nil
+	default:
+		return 0, unix.EAFNOSUPPORT
+	}
+}
+
+// sockaddr converts an address the kernel stored in raw, such as the peer of
+// an accepted connection. An unnamed Unix socket comes out as "@", as it does
+// from x/sys/unix.
+func sockaddr(raw *unix.RawSockaddrAny) unix.Sockaddr {
+	switch raw.Addr.Family {
+	case unix.AF_INET:
+		addr := (*unix.RawSockaddrInet4)(unsafe.Pointer(raw))
+		return &unix.SockaddrInet4{Port: port(addr.Port), Addr: addr.Addr}
+	case unix.AF_INET6:
+		addr := (*unix.RawSockaddrInet6)(unsafe.Pointer(raw))
+		return &unix.SockaddrInet6{Port: port(addr.Port), ZoneId: addr.Scope_id, Addr: addr.Addr}
+	case unix.AF_UNIX:
+		addr := (*unix.RawSockaddrUnix)(unsafe.Pointer(raw))
+		if addr.Path[0] == 0 {
+			addr.Path[0] = '@'
+		}
+		n := 0
+		for n < len(addr.Path) && addr.Path[n] != 0 {
+			n++
+		}
+		return &unix.SockaddrUnix{Name: string(unsafe.Slice((*byte)(unsafe.Pointer(&addr.Path[0])), n))}
+	default:
+		return nil
+	}
+}
+
+// putPort and port convert between a port number and the network byte order
+// it has in a socket address.
+func putPort(field *uint16, p int) {
+	b := (*[2]byte)(unsafe.Pointer(field))
+	b[0], b[1] = byte(p>>8), byte(p)
+}
+
+func port(field uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&field))
+	return int(b[0])<<8 | int(b[1])
+}
@@ -2,8 +2,13 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/stanleydv12/ginx/pkg/logger"
 
@@ -11,15 +16,293 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	AsyncMethodEpoll   = "epoll"
+	AsyncMethodIOUring = "io_uring"
+
+	DefaultHashKey = "ip"
+
+	HealthCheckHTTP = "http"
+	HealthCheckTCP  = "tcp"
+
+	DefaultHealthCheckPath     = "/"
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 5 * time.Second
+	DefaultHealthCheckRise     = 2
+	DefaultHealthCheckFall     = 3
+
+	DefaultUpstreamWeight      = 1
+	DefaultUpstreamMaxFails    = 1
+	DefaultUpstreamFailTimeout = 10 * time.Second
+
+	DefaultResolverInterval = 30 * time.Second
+	DefaultResolverTimeout  = 5 * time.Second
+
+	DefaultRetryTries               = 3
+	DefaultRetryBudgetRatio         = 0.2
+	DefaultRetryMinRetriesPerSecond = 10
+
+	DefaultKeepAliveTimeout  = 75 * time.Second
+	DefaultKeepAliveRequests = 1000
+
+	DefaultPoolMaxIdle     = 32
+	DefaultPoolIdleTimeout = 60 * time.Second
+
+	DefaultErrorPageContentType = "text/html; charset=utf-8"
+
+	DefaultClientHeaderTimeout    = 60 * time.Second
+	DefaultClientBodyTimeout      = 60 * time.Second
+	DefaultUpstreamConnectTimeout = 60 * time.Second
+	DefaultUpstreamReadTimeout    = 60 * time.Second
+	DefaultSendTimeout            = 60 * time.Second
+)
+
+// ErrorPagesConfig controls the bodies of the error responses ginx generates
+// itself, such as 502 when no upstream can be reached.
+type ErrorPagesConfig struct {
+	// ContentType is sent with every generated error body.
+	ContentType string `yaml:"content_type"`
+	// Template is a Go text/template rendered with .StatusCode and
+	// .StatusText. The built-in page is used when it is empty.
+	Template string `yaml:"template"`
+	// Pages maps status codes to files served verbatim instead of the
+	// template.
+	Pages map[int]string `yaml:"pages"`
+}
+
+// TimeoutConfig bounds how long a connection may wait on a peer in each phase
+// of a request.
+type TimeoutConfig struct {
+	// ClientHeader is how long a client has to send a complete request
+	// header, counted from its first byte.
+	ClientHeader time.Duration `yaml:"client_header"`
+	// ClientBody is how long a client may pause between two reads of the
+	// request body.
+	ClientBody time.Duration `yaml:"client_body"`
+	// UpstreamConnect is how long establishing an upstream connection may
+	// take.
+	UpstreamConnect time.Duration `yaml:"upstream_connect"`
+	// UpstreamRead is how long the upstream may pause between two reads
+	// of the response, including before the first one.
+	UpstreamRead time.Duration `yaml:"upstream_read"`
+	// Send is how long a peer may refuse to accept data we are writing to
+	// it.
+	Send time.Duration `yaml:"send"`
+}
+
+// UpstreamConfig describes one upstream server. A plain string is accepted
+// in its place as shorthand for an entry with only the URL set.
+type UpstreamConfig struct {
+	URL string `yaml:"url"`
+	// Weight is the server's share of requests relative to the others.
+	Weight int `yaml:"weight"`
+	// MaxFails is how many failed requests within FailTimeout mark the
+	// server as unavailable for FailTimeout. A negative value disables
+	// failure accounting.
+	MaxFails    int           `yaml:"max_fails"`
+	FailTimeout time.Duration `yaml:"fail_timeout"`
+	// Backup servers only receive requests when no other server is
+	// available.
+	Backup bool `yaml:"backup"`
+}
+
+// UnmarshalYAML accepts either a bare URL or a full upstream entry.
+func (u *UpstreamConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var url string
+	if err := unmarshal(&url); err == nil {
+		*u = UpstreamConfig{URL: url}
+		return nil
+	}
+
+	type plain UpstreamConfig
+	return unmarshal((*plain)(u))
+}
+
+// HealthCheckConfig controls the active health checks of the upstream
+// servers.
+type HealthCheckConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Type is "http" to GET Path or "tcp" to only open a connection.
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+	// ExpectedStatus lists the status codes that count as healthy. Any 2xx
+	// or 3xx does when it is empty.
+	ExpectedStatus []int         `yaml:"expected_status"`
+	Interval       time.Duration `yaml:"interval"`
+	Timeout        time.Duration `yaml:"timeout"`
+	// Rise is how many checks in a row must pass before a server that is
+	// down is used again, and Fall how many must fail to take it out.
+	Rise int `yaml:"rise"`
+	Fall int `yaml:"fall"`
+}
+
+// ResolverConfig controls how upstream host names are kept up to date with
+// DNS.
+type ResolverConfig struct {
+	// Interval is how often host names are resolved again. A negative
+	// value resolves them only at startup.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout bounds a single lookup.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// RetryConfig controls when a request that failed on one upstream server is
+// sent to another. A request is only retried if nothing was sent upstream yet,
+// or if it is an idempotent request without a body and no response had begun.
+type RetryConfig struct {
+	// Tries is the most servers a request is sent to, counting the first
+	// one. 1 disables retries.
+	Tries int `yaml:"tries"`
+	// BudgetRatio caps retries at this fraction of the requests of the
+	// last second, on top of MinRetriesPerSecond, so that failing
+	// upstreams do not see their load multiplied by retries.
+	BudgetRatio         float64 `yaml:"budget_ratio"`
+	MinRetriesPerSecond int     `yaml:"min_retries_per_second"`
+}
+
+// PoolConfig controls the pool of idle keep-alive upstream connections.
+type PoolConfig struct {
+	// MaxIdle is the number of idle connections kept per upstream server.
+	// A negative value disables pooling.
+	MaxIdle     int           `yaml:"max_idle"`
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+// ListenConfig is an address ginx accepts connections on.
+type ListenConfig struct {
+	// Address is the IPv4 or IPv6 address to listen on, or a Unix socket
+	// as "unix:<path>", for which Port is not needed. "::" listens on both
+	// IPv6 and IPv4 unless IPv6Only is set. IPv6 addresses may be written
+	// in brackets, as in "[::]", which LoadConfig removes.
+	Address  string `yaml:"address"`
+	Port     int    `yaml:"port"`
+	IPv6Only bool   `yaml:"ipv6_only"`
+}
+
+// VirtualHostConfig is one service fronted by ginx: the listeners and server
+// names it answers on and the upstream servers its requests go to.
+type VirtualHostConfig struct {
+	// Listen defaults to server.address and server.port.
+	Listen []ListenConfig `yaml:"listen"`
+	// ServerName lists the Host header values the virtual host answers
+	// to: exact names, "*.example.com" for any subdomain, or
+	// "www.example.*" for any top-level domain. Matching ignores case and
+	// the port.
+	ServerName []string `yaml:"server_name"`
+	// DefaultServer makes this the virtual host for requests on its
+	// listeners whose Host matches no server name. Otherwise the first
+	// virtual host on a listener is its default.
+	DefaultServer bool `yaml:"default_server"`
+	// Upstream names the group in server.upstreams that receives the
+	// requests no location sends elsewhere. Instead of naming one, the
+	// virtual host may list its own UpstreamServers, balanced by
+	// LoadBalancer and HashKey, which LoadConfig turns into a group of
+	// their own. Neither is needed if Locations cover every request.
+	Upstream        string           `yaml:"upstream"`
+	LoadBalancer    string           `yaml:"load_balancer"`
+	HashKey         string           `yaml:"hash_key"`
+	UpstreamServers []UpstreamConfig `yaml:"upstream_servers"`
+	// Locations route requests to upstream groups by path.
+	Locations []LocationConfig `yaml:"locations"`
+}
+
+// UpstreamGroupConfig is a named set of upstream servers that virtual hosts
+// and locations send requests to. Each group has its own load balancer,
+// health checks and connection pools.
+type UpstreamGroupConfig struct {
+	// LoadBalancer and HashKey default to server.load_balancer and
+	// server.hash_key.
+	LoadBalancer    string           `yaml:"load_balancer"`
+	HashKey         string           `yaml:"hash_key"`
+	UpstreamServers []UpstreamConfig `yaml:"upstream_servers"`
+	// HealthCheck replaces the top-level health_check for this group, with
+	// the fields it leaves out at their defaults, and UpstreamPool
+	// replaces server.upstream_pool in the same way. LoadConfig fills in
+	// the top-level settings when they are left out.
+	HealthCheck  *HealthCheckConfig `yaml:"health_check"`
+	UpstreamPool *PoolConfig        `yaml:"upstream_pool"`
+}
+
+// LocationConfig sends the requests whose path it matches to an upstream
+// group, optionally rewriting the path first.
+type LocationConfig struct {
+	// Path is matched as in nginx: "= /path" matches only that path,
+	// "/prefix" and "^~ /prefix" match paths starting with the prefix,
+	// and "~ regexp" and "~* regexp" match a regular expression, the
+	// latter ignoring case.
+	Path string `yaml:"path"`
+	// Upstream names a group in server.upstreams. Empty sends requests to
+	// the virtual host's upstream.
+	Upstream string `yaml:"upstream"`
+	// StripPrefix removes the matched prefix from the path before the
+	// request is forwarded. It needs a prefix or exact location.
+	StripPrefix bool `yaml:"strip_prefix"`
+	// Rewrite replaces the matched prefix, or for a regexp location the
+	// matched part of the path, which may refer to the regexp's groups
+	// as $1 or ${name}.
+	Rewrite string `yaml:"rewrite"`
+}
+
+// Name identifies the virtual host in logs and errors by its first server
+// name, or "_" if it has none.
+func (v VirtualHostConfig) Name() string {
+	if len(v.ServerName) == 0 {
+		return "_"
+	}
+	return v.ServerName[0]
+}
+
 type ServerConfig struct {
 	Server struct {
-		Address         string   `yaml:"address"`
-		Port            int      `yaml:"port"`
-		AsyncMethod     string   `yaml:"async_method"`
-		LoadBalancer    string   `yaml:"load_balancer"`
-		UpstreamServers []string `yaml:"upstream_servers"`
-		MaxOpenFiles    int      `yaml:"max_open_files"`
+		ListenConfig `yaml:",inline"`
+		// VirtualHosts split requests between services by listener and
+		// Host header. Without any, every request goes to
+		// UpstreamServers, or is routed by Locations; with them, those two
+		// must be left out.
+		VirtualHosts []VirtualHostConfig `yaml:"virtual_hosts"`
+		// Upstreams are the upstream groups virtual hosts and locations
+		// refer to by name. After LoadConfig it also holds the groups made
+		// of the upstream servers listed by virtual hosts themselves.
+		Upstreams map[string]UpstreamGroupConfig `yaml:"upstreams"`
+		Locations []LocationConfig               `yaml:"locations"`
+		// AsyncMethod is the event notification backend, "epoll" or
+		// "io_uring". io_uring falls back to epoll if the kernel lacks it.
+		AsyncMethod  string `yaml:"async_method"`
+		LoadBalancer string `yaml:"load_balancer"`
+		// HashKey is what the consistent_hash balancer hashes: "ip", "path",
+		// "header:<name>" or "cookie:<name>".
+		HashKey         string           `yaml:"hash_key"`
+		UpstreamServers []UpstreamConfig `yaml:"upstream_servers"`
+		// Resolver re-resolves upstream host names, each of which stands
+		// for all the addresses it resolves to.
+		Resolver     ResolverConfig `yaml:"resolver"`
+		MaxOpenFiles int            `yaml:"max_open_files"`
+		// Workers is the number of event loops, each with its own
+		// SO_REUSEPORT listener. Zero means one per CPU.
+		Workers int `yaml:"workers"`
+		// WorkerCPUAffinity pins each worker to its own CPU.
+		WorkerCPUAffinity bool `yaml:"worker_cpu_affinity"`
+		// KeepAliveTimeout is how long an idle client connection is kept
+		// open waiting for its next request.
+		KeepAliveTimeout time.Duration `yaml:"keep_alive_timeout"`
+		// KeepAliveRequests caps how many requests a single client
+		// connection may serve before it is closed.
+		KeepAliveRequests int         `yaml:"keep_alive_requests"`
+		UpstreamPool      PoolConfig  `yaml:"upstream_pool"`
+		Retries           RetryConfig `yaml:"retries"`
+		// PreserveHost forwards the client's Host header unchanged instead
+		// of replacing it with the upstream server's host.
+		PreserveHost bool `yaml:"preserve_host"`
+		// TrustedProxies lists the addresses or CIDR ranges of proxies whose
+		// X-Forwarded-For and Forwarded headers are believed.
+		TrustedProxies []string `yaml:"trusted_proxies"`
+		// ClientMaxBodySize caps the size of a request body in bytes;
+		// larger requests are answered with 413. Zero means no limit.
+		ClientMaxBodySize int64            `yaml:"client_max_body_size"`
+		ErrorPages        ErrorPagesConfig `yaml:"error_pages"`
+		Timeouts          TimeoutConfig    `yaml:"timeouts"`
 	} `yaml:"server"`
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
 }
 
 func LoadConfig() (*ServerConfig, error) {
@@ -59,18 +342,325 @@ func LoadConfig() (*ServerConfig, error) {
 	}
 
 	// Validate required fields
-	if cfg.Server.Port == 0 {
-		logger.Error("server.port is required")
-		return nil, errors.New("server.port is required")
+	cfg.Server.Address = unbracketAddress(cfg.Server.Address)
+	implicitVirtualHost := len(cfg.Server.VirtualHosts) == 0
+	if implicitVirtualHost {
+		if cfg.Server.Port == 0 && !strings.HasPrefix(cfg.Server.Address, "unix:") {
+			logger.Error("server.port is required")
+			return nil, errors.New("server.port is required")
+		}
+		if len(cfg.Server.UpstreamServers) == 0 && len(cfg.Server.Locations) == 0 {
+			logger.Error("at least one upstream server is required")
+			return nil, errors.New("at least one upstream server is required")
+		}
+
+		// The server block then describes the only virtual host.
+		cfg.Server.VirtualHosts = []VirtualHostConfig{{
+			UpstreamServers: cfg.Server.UpstreamServers,
+			Locations:       cfg.Server.Locations,
+		}}
+	} else if len(cfg.Server.UpstreamServers) > 0 || len(cfg.Server.Locations) > 0 {
+		// Virtual hosts list their own, so these would go unused.
+		logger.Error("server.upstream_servers and server.locations cannot be set with server.virtual_hosts")
+		return nil, errors.New("server.upstream_servers and server.locations cannot be set with server.virtual_hosts")
 	}
-	if len(cfg.Server.UpstreamServers) == 0 {
-		logger.Error("at least one upstream server is required")
-		return nil, errors.New("at least one upstream server is required")
+	for name, group := range cfg.Server.Upstreams {
+		if len(group.UpstreamServers) == 0 {
+			logger.Error("at least one upstream server is required", "upstream", name)
+			return nil, fmt.Errorf("upstream %s: at least one upstream server is required", name)
+		}
+		if err := validateUpstreamServers(group.UpstreamServers); err != nil {
+			return nil, err
+		}
+		if group.HealthCheck != nil {
+			if err := validateHealthCheck(*group.HealthCheck); err != nil {
+				return nil, fmt.Errorf("upstream %s: %w", name, err)
+			}
+		}
+	}
+	for i := range cfg.Server.VirtualHosts {
+		vhost := &cfg.Server.VirtualHosts[i]
+		if len(vhost.Listen) == 0 {
+			vhost.Listen = []ListenConfig{cfg.Server.ListenConfig}
+		}
+		for j := range vhost.Listen {
+			vhost.Listen[j].Address = unbracketAddress(vhost.Listen[j].Address)
+		}
+		for _, listen := range vhost.Listen {
+			if listen.Port == 0 && !strings.HasPrefix(listen.Address, "unix:") {
+				logger.Error("virtual host listen port is required", "virtual_host", vhost.Name())
+				return nil, fmt.Errorf("virtual host %s: listen port is required", vhost.Name())
+			}
+		}
+		switch {
+		case len(vhost.UpstreamServers) > 0 && vhost.Upstream != "":
+			logger.Error("virtual host upstream and upstream_servers cannot both be set", "virtual_host", vhost.Name())
+			return nil, fmt.Errorf("virtual host %s: upstream and upstream_servers cannot both be set", vhost.Name())
+		case len(vhost.UpstreamServers) > 0:
+			if err := validateUpstreamServers(vhost.UpstreamServers); err != nil {
+				return nil, err
+			}
+		case vhost.Upstream != "":
+			if _, exists := cfg.Server.Upstreams[vhost.Upstream]; !exists {
+				logger.Error("virtual host refers to an unknown upstream", "virtual_host", vhost.Name(), "upstream", vhost.Upstream)
+				return nil, fmt.Errorf("virtual host %s: unknown upstream %q", vhost.Name(), vhost.Upstream)
+			}
+		case len(vhost.Locations) == 0:
+			logger.Error("at least one upstream server is required", "virtual_host", vhost.Name())
+			return nil, fmt.Errorf("virtual host %s: at least one upstream server is required", vhost.Name())
+		}
+		for _, location := range vhost.Locations {
+			if location.Upstream == "" {
+				if len(vhost.UpstreamServers) == 0 && vhost.Upstream == "" {
+					logger.Error("location needs an upstream", "virtual_host", vhost.Name(), "location", location.Path)
+					return nil, fmt.Errorf("virtual host %s: location %q needs an upstream, as the virtual host has none", vhost.Name(), location.Path)
+				}
+				continue
+			}
+			if _, exists := cfg.Server.Upstreams[location.Upstream]; !exists {
+				logger.Error("location refers to an unknown upstream", "virtual_host", vhost.Name(), "location", location.Path, "upstream", location.Upstream)
+				return nil, fmt.Errorf("virtual host %s: location %q refers to unknown upstream %q", vhost.Name(), location.Path, location.Upstream)
+			}
+		}
 	}
 	if cfg.Server.MaxOpenFiles == 0 {
 		logger.Error("server.max_open_files is required")
 		return nil, errors.New("server.max_open_files is required")
 	}
 
+	if _, err := ParseTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		logger.Error("Invalid server.trusted_proxies", "error", err)
+		return nil, err
+	}
+
+	switch cfg.Server.AsyncMethod {
+	case "", AsyncMethodEpoll, AsyncMethodIOUring:
+	default:
+		logger.Error("server.async_method must be epoll or io_uring", "async_method", cfg.Server.AsyncMethod)
+		return nil, fmt.Errorf("unknown server.async_method %q", cfg.Server.AsyncMethod)
+	}
+
+	if err := validateHealthCheck(cfg.HealthCheck); err != nil {
+		return nil, err
+	}
+
+	if cfg.Server.Retries.Tries < 0 || cfg.Server.Retries.BudgetRatio < 0 || cfg.Server.Retries.MinRetriesPerSecond < 0 {
+		logger.Error("server.retries settings must not be negative")
+		return nil, errors.New("server.retries settings must not be negative")
+	}
+
+	if cfg.Server.Workers < 0 {
+		logger.Error("server.workers must not be negative")
+		return nil, errors.New("server.workers must not be negative")
+	}
+
+	// Apply defaults
+	if cfg.Server.AsyncMethod == "" {
+		cfg.Server.AsyncMethod = AsyncMethodEpoll
+	}
+	if cfg.Server.HashKey == "" {
+		cfg.Server.HashKey = DefaultHashKey
+	}
+	if cfg.Server.Workers == 0 {
+		cfg.Server.Workers = runtime.NumCPU()
+	}
+	if cfg.Server.Resolver.Interval == 0 {
+		cfg.Server.Resolver.Interval = DefaultResolverInterval
+	}
+	if cfg.Server.Resolver.Timeout == 0 {
+		cfg.Server.Resolver.Timeout = DefaultResolverTimeout
+	}
+	if cfg.Server.KeepAliveTimeout == 0 {
+		cfg.Server.KeepAliveTimeout = DefaultKeepAliveTimeout
+	}
+	if cfg.Server.KeepAliveRequests == 0 {
+		cfg.Server.KeepAliveRequests = DefaultKeepAliveRequests
+	}
+	applyPoolDefaults(&cfg.Server.UpstreamPool)
+	if cfg.Server.Retries.Tries == 0 {
+		cfg.Server.Retries.Tries = DefaultRetryTries
+	}
+	if cfg.Server.Retries.BudgetRatio == 0 {
+		cfg.Server.Retries.BudgetRatio = DefaultRetryBudgetRatio
+	}
+	if cfg.Server.Retries.MinRetriesPerSecond == 0 {
+		cfg.Server.Retries.MinRetriesPerSecond = DefaultRetryMinRetriesPerSecond
+	}
+	if cfg.Server.ErrorPages.ContentType == "" {
+		cfg.Server.ErrorPages.ContentType = DefaultErrorPageContentType
+	}
+	if cfg.Server.Timeouts.ClientHeader == 0 {
+		cfg.Server.Timeouts.ClientHeader = DefaultClientHeaderTimeout
+	}
+	if cfg.Server.Timeouts.ClientBody == 0 {
+		cfg.Server.Timeouts.ClientBody = DefaultClientBodyTimeout
+	}
+	if cfg.Server.Timeouts.UpstreamConnect == 0 {
+		cfg.Server.Timeouts.UpstreamConnect = DefaultUpstreamConnectTimeout
+	}
+	if cfg.Server.Timeouts.UpstreamRead == 0 {
+		cfg.Server.Timeouts.UpstreamRead = DefaultUpstreamReadTimeout
+	}
+	if cfg.Server.Timeouts.Send == 0 {
+		cfg.Server.Timeouts.Send = DefaultSendTimeout
+	}
+	applyHealthCheckDefaults(&cfg.HealthCheck)
+
+	// The upstream servers a virtual host lists itself form a group named
+	// after where they are configured.
+	if cfg.Server.Upstreams == nil {
+		cfg.Server.Upstreams = make(map[string]UpstreamGroupConfig)
+	}
+	for i := range cfg.Server.VirtualHosts {
+		vhost := &cfg.Server.VirtualHosts[i]
+		if len(vhost.UpstreamServers) == 0 {
+			continue
+		}
+
+		name := fmt.Sprintf("virtual_hosts[%d]", i)
+		if implicitVirtualHost {
+			name = "upstream_servers"
+		}
+		if _, exists := cfg.Server.Upstreams[name]; exists {
+			logger.Error("upstream name is reserved", "upstream", name)
+			return nil, fmt.Errorf("upstream name %q is reserved for the upstream servers of a virtual host", name)
+		}
+		cfg.Server.Upstreams[name] = UpstreamGroupConfig{
+			LoadBalancer:    vhost.LoadBalancer,
+			HashKey:         vhost.HashKey,
+			UpstreamServers: vhost.UpstreamServers,
+		}
+		vhost.Upstream = name
+	}
+	for name, group := range cfg.Server.Upstreams {
+		if group.LoadBalancer == "" {
+			group.LoadBalancer = cfg.Server.LoadBalancer
+		}
+		if group.HashKey == "" {
+			group.HashKey = cfg.Server.HashKey
+		}
+		applyUpstreamDefaults(group.UpstreamServers)
+		if group.HealthCheck == nil {
+			healthCheck := cfg.HealthCheck
+			group.HealthCheck = &healthCheck
+		} else {
+			applyHealthCheckDefaults(group.HealthCheck)
+		}
+		if group.UpstreamPool == nil {
+			pool := cfg.Server.UpstreamPool
+			group.UpstreamPool = &pool
+		} else {
+			applyPoolDefaults(group.UpstreamPool)
+		}
+		cfg.Server.Upstreams[name] = group
+	}
+
 	return &cfg, nil
 }
+
+// unbracketAddress removes the brackets around an IPv6 listen address, which
+// the socket layer expects bare.
+func unbracketAddress(address string) string {
+	if strings.HasPrefix(address, "[") && strings.HasSuffix(address, "]") {
+		return address[1 : len(address)-1]
+	}
+	return address
+}
+
+// validateUpstreamServers checks the entries of an upstream server list.
+func validateUpstreamServers(upstreams []UpstreamConfig) error {
+	for _, upstream := range upstreams {
+		if upstream.URL == "" {
+			logger.Error("upstream server url is required")
+			return errors.New("upstream server url is required")
+		}
+		if upstream.Weight < 0 {
+			logger.Error("upstream server weight must not be negative", "url", upstream.URL)
+			return fmt.Errorf("upstream server %s: weight must not be negative", upstream.URL)
+		}
+	}
+	return nil
+}
+
+// applyUpstreamDefaults fills in the settings an upstream server list leaves
+// out.
+func applyUpstreamDefaults(upstreams []UpstreamConfig) {
+	for i := range upstreams {
+		upstream := &upstreams[i]
+		if upstream.Weight == 0 {
+			upstream.Weight = DefaultUpstreamWeight
+		}
+		if upstream.MaxFails == 0 {
+			upstream.MaxFails = DefaultUpstreamMaxFails
+		}
+		if upstream.FailTimeout == 0 {
+			upstream.FailTimeout = DefaultUpstreamFailTimeout
+		}
+	}
+}
+
+// validateHealthCheck checks the settings of a health_check block.
+func validateHealthCheck(healthCheck HealthCheckConfig) error {
+	switch healthCheck.Type {
+	case "", HealthCheckHTTP, HealthCheckTCP:
+		return nil
+	default:
+		logger.Error("health_check.type must be http or tcp", "type", healthCheck.Type)
+		return fmt.Errorf("unknown health_check.type %q", healthCheck.Type)
+	}
+}
+
+// applyHealthCheckDefaults fills in the settings a health_check block leaves
+// out.
+func applyHealthCheckDefaults(healthCheck *HealthCheckConfig) {
+	if healthCheck.Type == "" {
+		healthCheck.Type = HealthCheckHTTP
+	}
+	if healthCheck.Path == "" {
+		healthCheck.Path = DefaultHealthCheckPath
+	}
+	if healthCheck.Interval == 0 {
+		healthCheck.Interval = DefaultHealthCheckInterval
+	}
+	if healthCheck.Timeout == 0 {
+		healthCheck.Timeout = DefaultHealthCheckTimeout
+	}
+	if healthCheck.Rise == 0 {
+		healthCheck.Rise = DefaultHealthCheckRise
+	}
+	if healthCheck.Fall == 0 {
+		healthCheck.Fall = DefaultHealthCheckFall
+	}
+}
+
+// applyPoolDefaults fills in the settings an upstream_pool block leaves out.
+func applyPoolDefaults(pool *PoolConfig) {
+	if pool.MaxIdle == 0 {
+		pool.MaxIdle = DefaultPoolMaxIdle
+	}
+	if pool.IdleTimeout == 0 {
+		pool.IdleTimeout = DefaultPoolIdleTimeout
+	}
+}
+
+// ParseTrustedProxies parses a list of IP addresses and CIDR ranges. A bare
+// address is treated as a single-host range.
+func ParseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
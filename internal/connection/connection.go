@@ -4,17 +4,106 @@ package connection
 
 import (
 	"github.com/stanleydv12/ginx/internal/entity"
+	"github.com/stanleydv12/ginx/internal/parser"
 )
 
 type Connection struct {
-	ClientFD       int
-	ClientAddress  string
+	ClientFD int
+	// ClientAddress is the client's socket address in host:port form.
+	ClientAddress string
+	// Listener is the index of the server listener that accepted the
+	// client.
+	Listener int
+	// Upstream names the upstream group that serves the current request,
+	// chosen by its virtual host and location.
+	Upstream       string
 	UpstreamFD     int
 	UpstreamServer entity.UpstreamServer
 	Request        entity.HTTPRequest
 	Response       entity.HTTPResponse
-	State  ConnectionState
-	Closed bool
+	State          ConnectionState
+	Closed         bool
+
+	// ReadBuffer holds client bytes that have been read but not yet consumed
+	// by the request parser.
+	ReadBuffer []byte
+	// UpstreamBuffer holds request bytes waiting to be written upstream.
+	UpstreamBuffer []byte
+	// RequestHeaderSize is the length of the rewritten header at the front
+	// of UpstreamBuffer, so it can be replaced if the request is retried.
+	RequestHeaderSize int
+	// RequestParser incrementally parses requests from the client. It is
+	// reused for every request on the connection.
+	RequestParser *parser.MessageParser
+	// RequestBodySize counts the request body bytes received so far.
+	RequestBodySize int64
+
+	// ResponseParser incrementally parses the upstream response.
+	ResponseParser *parser.MessageParser
+	// ClientBuffer holds response bytes waiting to be written to the client.
+	ClientBuffer []byte
+	// DechunkResponse reports whether a chunked response body is decoded
+	// before being sent, for clients that do not understand chunked framing.
+	DechunkResponse bool
+	// ChunkResponse reports whether a close-delimited response body is
+	// re-framed as chunked, so the client connection can be kept alive.
+	ChunkResponse bool
+	// ClientWriteBlocked reports whether EPOLLOUT is armed on the client fd
+	// because the last write could not complete.
+	ClientWriteBlocked bool
+	// BytesSent counts response bytes written to the client.
+	BytesSent int64
+	// UpstreamReusable reports whether the upstream connection can be
+	// returned to the pool once the response has been fully read.
+	UpstreamReusable bool
+	// UpstreamPooled reports whether the upstream connection was taken
+	// from the pool rather than opened for this request.
+	UpstreamPooled bool
+	// UpstreamBytesSent and UpstreamBytesReceived count what went over the
+	// current upstream connection, which decides whether a failed request
+	// can be retried.
+	UpstreamBytesSent     int64
+	UpstreamBytesReceived int64
+	// TriedServers lists the servers the request has already failed on.
+	TriedServers []entity.UpstreamServer
+
+	// KeepAlive reports whether the client connection should be reused for
+	// another request once the current response has been delivered.
+	KeepAlive bool
+	// Requests counts the requests served over this client connection.
+	Requests int
+	// Timeout is what the connection is currently waiting for, which decides
+	// how its pending timer is handled when it fires.
+	Timeout TimeoutPhase
+}
+
+// ResetForNextRequest clears all per-request state so the client connection
+// can be reused for another request. Bytes already read from the client past
+// the previous request are kept in ReadBuffer.
+func (c *Connection) ResetForNextRequest() {
+	c.Upstream = ""
+	c.UpstreamFD = 0
+	c.UpstreamServer = entity.UpstreamServer{}
+	c.Request = entity.HTTPRequest{}
+	c.Response = entity.HTTPResponse{}
+	c.UpstreamBuffer = nil
+	c.RequestHeaderSize = 0
+	c.RequestBodySize = 0
+	if c.RequestParser != nil {
+		c.RequestParser.Reset()
+	}
+	c.ResponseParser = nil
+	c.ClientBuffer = nil
+	c.DechunkResponse = false
+	c.ChunkResponse = false
+	c.BytesSent = 0
+	c.UpstreamReusable = false
+	c.UpstreamPooled = false
+	c.UpstreamBytesSent = 0
+	c.UpstreamBytesReceived = 0
+	c.TriedServers = nil
+	c.KeepAlive = false
+	c.State = StateClientAccepted
 }
 
 type ConnectionState string
@@ -29,3 +118,22 @@ const (
 	StateCompleted          ConnectionState = "completed"
 	StateError              ConnectionState = "error"
 )
+
+// TimeoutPhase identifies which timeout applies to a connection.
+type TimeoutPhase int
+
+const (
+	TimeoutNone TimeoutPhase = iota
+	// TimeoutKeepAlive waits for the next request on an idle connection.
+	TimeoutKeepAlive
+	// TimeoutClientHeader waits for the client to finish the request header.
+	TimeoutClientHeader
+	// TimeoutClientBody waits for more of the request body.
+	TimeoutClientBody
+	// TimeoutUpstreamConnect waits for the upstream connect to complete.
+	TimeoutUpstreamConnect
+	// TimeoutUpstreamRead waits for more of the upstream response.
+	TimeoutUpstreamRead
+	// TimeoutSend waits for a peer to accept more data from us.
+	TimeoutSend
+)
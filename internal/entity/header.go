@@ -0,0 +1,106 @@
+//go:build linux
+
+package entity
+
+import "strings"
+
+// HeaderField is a single header line as it appeared on the wire.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Header is an ordered list of header fields. Lookups ignore case, but field
+// names keep the case they were added with, and repeated fields such as
+// Set-Cookie are kept as separate entries in their original order.
+//
+// The zero value is an empty header ready to use. Header shares its backing
+// storage when copied, so use Clone before modifying a copy independently.
+type Header struct {
+	fields []HeaderField
+}
+
+// Get returns the first value of the named field, or "" if it is not present.
+func (h Header) Get(name string) string {
+	for _, field := range h.fields {
+		if strings.EqualFold(field.Name, name) {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// Has reports whether the named field is present.
+func (h Header) Has(name string) bool {
+	for _, field := range h.fields {
+		if strings.EqualFold(field.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Values returns every value of the named field, in order.
+func (h Header) Values(name string) []string {
+	var values []string
+	for _, field := range h.fields {
+		if strings.EqualFold(field.Name, name) {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+// Add appends a field, keeping any existing fields with the same name.
+func (h *Header) Add(name, value string) {
+	h.fields = append(h.fields, HeaderField{Name: name, Value: value})
+}
+
+// Set replaces every field with the given name by a single one. The field
+// keeps the position of the first one it replaces, or is appended if there
+// was none.
+func (h *Header) Set(name, value string) {
+	for i, field := range h.fields {
+		if strings.EqualFold(field.Name, name) {
+			h.fields[i] = HeaderField{Name: name, Value: value}
+			h.fields = append(h.fields[:i+1], removeFields(h.fields[i+1:], name)...)
+			return
+		}
+	}
+	h.Add(name, value)
+}
+
+// Del removes every field with the given name.
+func (h *Header) Del(name string) {
+	h.fields = removeFields(h.fields, name)
+}
+
+// Fields returns the fields in order. The returned slice must not be
+// modified.
+func (h Header) Fields() []HeaderField {
+	return h.fields
+}
+
+// Len returns the number of fields, counting repeated fields separately.
+func (h Header) Len() int {
+	return len(h.fields)
+}
+
+// Clone returns a copy of h that does not share storage with it.
+func (h Header) Clone() Header {
+	if h.fields == nil {
+		return Header{}
+	}
+	return Header{fields: append([]HeaderField(nil), h.fields...)}
+}
+
+// removeFields filters fields named name out of fields in place.
+func removeFields(fields []HeaderField, name string) []HeaderField {
+	kept := fields[:0]
+	for _, field := range fields {
+		if !strings.EqualFold(field.Name, name) {
+			kept = append(kept, field)
+		}
+	}
+	return kept
+}
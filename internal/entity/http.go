@@ -3,17 +3,17 @@
 package entity
 
 type HTTPRequest struct {
-	Method string
-	Path   string
+	Method   string
+	Path     string
 	Protocol string
-	Headers map[string]string
-	Body   []byte
-	Raw    []byte
+	Headers  Header
+	Body     []byte
 }
 
 type HTTPResponse struct {
+	Protocol   string
 	StatusCode int
-	Headers map[string]string
-	Body   []byte
-	Raw    []byte
-}
\ No newline at end of file
+	Reason     string
+	Headers    Header
+	Body       []byte
+}
@@ -1,8 +1,20 @@
 package entity
 
-import "net/url"
+import (
+	"net/url"
+	"time"
+)
 
 type UpstreamServer struct {
 	URL    *url.URL
 	Weight int
+	// MaxFails failed requests within FailTimeout take the server out of
+	// rotation for FailTimeout. A negative value disables this.
+	MaxFails    int
+	FailTimeout time.Duration
+	// Backup servers are only used when no other server is available.
+	Backup bool
+	// SocketPath is set for a server reached over a Unix domain socket,
+	// whose URL.Host is then "unix:" and the path, which only identifies it.
+	SocketPath string
 }
\ No newline at end of file
@@ -0,0 +1,101 @@
+//go:build linux
+
+package errorpage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"text/template"
+
+	"github.com/stanleydv12/ginx/internal/config"
+	"github.com/stanleydv12/ginx/internal/parser"
+)
+
+// defaultTemplate is the page used when no template is configured.
+const defaultTemplate = `<html>
+<head><title>{{.StatusCode}} {{.StatusText}}</title></head>
+<body>
+<center><h1>{{.StatusCode}} {{.StatusText}}</h1></center>
+<hr><center>ginx</center>
+</body>
+</html>
+`
+
+type ErrorPageHandler interface {
+	// Render returns the content type and body of the error response for
+	// statusCode.
+	Render(statusCode int) (contentType string, body []byte)
+}
+
+// ErrorPages renders every page up front, so serving an error never touches
+// the disk or runs a template on the event loop.
+type ErrorPages struct {
+	contentType string
+	template    *template.Template
+	pages       map[int][]byte
+}
+
+// pageData is what templates are rendered with.
+type pageData struct {
+	StatusCode int
+	StatusText string
+}
+
+func NewErrorPages(cfg config.ErrorPagesConfig) (ErrorPageHandler, error) {
+	text := cfg.Template
+	if text == "" {
+		text = defaultTemplate
+	}
+	tmpl, err := template.New("error_page").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid error page template: %v", err)
+	}
+
+	e := &ErrorPages{
+		contentType: cfg.ContentType,
+		template:    tmpl,
+		pages:       make(map[int][]byte),
+	}
+
+	for _, statusCode := range parser.StatusCodes() {
+		if statusCode < 400 {
+			continue
+		}
+		body, err := e.render(statusCode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render error page for %d: %v", statusCode, err)
+		}
+		e.pages[statusCode] = body
+	}
+
+	for statusCode, path := range cfg.Pages {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read error page for %d: %v", statusCode, err)
+		}
+		e.pages[statusCode] = body
+	}
+
+	return e, nil
+}
+
+func (e *ErrorPages) Render(statusCode int) (string, []byte) {
+	if body, ok := e.pages[statusCode]; ok {
+		return e.contentType, body
+	}
+	body, err := e.render(statusCode)
+	if err != nil {
+		return "text/plain; charset=utf-8", []byte(fmt.Sprintf("%d %s\n", statusCode, parser.HTTPStatusCode(statusCode)))
+	}
+	return e.contentType, body
+}
+
+func (e *ErrorPages) render(statusCode int) ([]byte, error) {
+	var buf bytes.Buffer
+	err := e.template.Execute(&buf, pageData{
+		StatusCode: statusCode,
+		StatusText: parser.HTTPStatusCode(statusCode),
+	})
+	return buf.Bytes(), err
+}
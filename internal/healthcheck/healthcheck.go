@@ -0,0 +1,284 @@
+//go:build linux
+
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/stanleydv12/ginx/internal/config"
+	"github.com/stanleydv12/ginx/internal/entity"
+	"github.com/stanleydv12/ginx/pkg/logger"
+)
+
+// HealthCheckHandler probes the upstream servers in the background, keeps
+// track of the requests that fail on them, and tells the load balancers which
+// of them may receive requests.
+type HealthCheckHandler interface {
+	// Start begins probing. It returns immediately.
+	Start()
+	// Stop ends probing and waits for the probes in flight.
+	Stop()
+	// Healthy reports whether server passed its recent checks and is not
+	// ejected for failing requests. Servers that are not checked are always
+	// healthy.
+	Healthy(server entity.UpstreamServer) bool
+	// ReportFailure records that a request to server failed. MaxFails
+	// failures within FailTimeout eject the server for FailTimeout.
+	ReportFailure(server entity.UpstreamServer)
+	AddServer(server entity.UpstreamServer)
+	RemoveServer(server entity.UpstreamServer)
+}
+
+// serverState is the check history of one upstream server.
+type serverState struct {
+	server  entity.UpstreamServer
+	healthy bool
+	// passes and fails count the checks in a row with the same outcome.
+	passes int
+	fails  int
+	// failures counts the requests that failed since failuresSince, and
+	// the server takes no requests until ejectedUntil.
+	failures      int
+	failuresSince time.Time
+	ejectedUntil  time.Time
+}
+
+// HealthChecker probes every server once per interval, all in parallel. A
+// server starts out healthy, goes down after Fall failed checks in a row and
+// comes back after Rise passed ones.
+//
+// Failed requests are tracked whether or not probing is enabled, as nginx's
+// max_fails and fail_timeout are.
+type HealthChecker struct {
+	config config.HealthCheckConfig
+	client *http.Client
+
+	mu sync.RWMutex
+	// servers is keyed by the server itself, as servers may share a host.
+	servers map[entity.UpstreamServer]*serverState
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewHealthChecker(cfg config.HealthCheckConfig, upstreamServers []entity.UpstreamServer) HealthCheckHandler {
+	h := &HealthChecker{
+		config: cfg,
+		client: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: &http.Transport{DisableKeepAlives: true},
+			// A redirect is an answer; following it would check some
+			// other server.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		servers: make(map[entity.UpstreamServer]*serverState),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, server := range upstreamServers {
+		h.AddServer(server)
+	}
+	return h
+}
+
+func (h *HealthChecker) Start() {
+	if !h.config.Enabled {
+		close(h.done)
+		return
+	}
+
+	logger.Info("Starting upstream health checks", "type", h.config.Type, "interval", h.config.Interval.String())
+	go h.run()
+}
+
+func (h *HealthChecker) Stop() {
+	select {
+	case <-h.stop:
+	default:
+		close(h.stop)
+	}
+	<-h.done
+}
+
+func (h *HealthChecker) Healthy(server entity.UpstreamServer) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	state, exists := h.servers[server]
+	return !exists || (state.healthy && !time.Now().Before(state.ejectedUntil))
+}
+
+func (h *HealthChecker) ReportFailure(server entity.UpstreamServer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	state, exists := h.servers[server]
+	if !exists || state.server.MaxFails <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(state.failuresSince) >= state.server.FailTimeout {
+		state.failures = 0
+		state.failuresSince = now
+	}
+	state.failures++
+	if state.failures < state.server.MaxFails {
+		return
+	}
+
+	state.failures = 0
+	state.ejectedUntil = now.Add(state.server.FailTimeout)
+	logger.Error("Upstream server ejected after failed requests", "upstream_host", server.URL.Host, "max_fails", state.server.MaxFails, "fail_timeout", state.server.FailTimeout.String())
+}
+
+func (h *HealthChecker) AddServer(server entity.UpstreamServer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, exists := h.servers[server]; !exists {
+		h.servers[server] = &serverState{server: server, healthy: true}
+	}
+}
+
+func (h *HealthChecker) RemoveServer(server entity.UpstreamServer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.servers, server)
+}
+
+func (h *HealthChecker) run() {
+	defer close(h.done)
+
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		h.checkAll()
+
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll probes every server in parallel and waits for all of them.
+func (h *HealthChecker) checkAll() {
+	h.mu.RLock()
+	servers := make([]entity.UpstreamServer, 0, len(h.servers))
+	for _, state := range h.servers {
+		servers = append(servers, state.server)
+	}
+	h.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server entity.UpstreamServer) {
+			defer wg.Done()
+			h.record(server, h.probe(server))
+		}(server)
+	}
+	wg.Wait()
+}
+
+// probe runs a single check against server.
+func (h *HealthChecker) probe(server entity.UpstreamServer) error {
+	network, address := "tcp", server.URL.Host
+	if server.SocketPath != "" {
+		network, address = "unix", server.SocketPath
+	}
+
+	if h.config.Type == config.HealthCheckTCP {
+		conn, err := net.DialTimeout(network, address, h.config.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client, host := h.client, server.URL.Host
+	if server.SocketPath != "" {
+		client, host = h.unixClient(server.SocketPath), "localhost"
+	}
+
+	req, err := http.NewRequest(http.MethodGet, server.URL.Scheme+"://"+host+h.config.Path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "ginx-health-check")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if !h.expectedStatus(resp.StatusCode) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// unixClient returns a client like h.client that connects to the Unix socket
+// at path whatever the URL says.
+func (h *HealthChecker) unixClient(path string) *http.Client {
+	client := *h.client
+	client.Transport = &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}
+	return &client
+}
+
+func (h *HealthChecker) expectedStatus(statusCode int) bool {
+	if len(h.config.ExpectedStatus) == 0 {
+		return statusCode >= 200 && statusCode < 400
+	}
+	return slices.Contains(h.config.ExpectedStatus, statusCode)
+}
+
+// record applies the outcome of a check to the server's state.
+func (h *HealthChecker) record(server entity.UpstreamServer, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	state, exists := h.servers[server]
+	if !exists {
+		return // Removed while it was being checked
+	}
+
+	if err != nil {
+		state.passes = 0
+		state.fails++
+		logger.Debug("Upstream health check failed", "upstream_host", server.URL.Host, "fails", state.fails, "error", err)
+		if state.healthy && state.fails >= h.config.Fall {
+			state.healthy = false
+			logger.Error("Upstream server marked unhealthy", "upstream_host", server.URL.Host, "error", err)
+		}
+		return
+	}
+
+	state.fails = 0
+	state.passes++
+	if !state.healthy && state.passes >= h.config.Rise {
+		state.healthy = true
+		logger.Info("Upstream server is healthy again", "upstream_host", server.URL.Host)
+	}
+}
@@ -0,0 +1,182 @@
+//go:build linux
+
+package loadbalancer
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/stanleydv12/ginx/internal/entity"
+)
+
+// pointsPerServer is how many points a server of weight 1 gets on the hash
+// ring. As in ketama, every MD5 digest yields four of them.
+const pointsPerServer = 160
+
+// ringPoint is one position on the hash ring and the server owning it.
+type ringPoint struct {
+	hash   uint32
+	server int
+}
+
+// ConsistentHashLoadBalancer maps a key taken from each request onto a
+// ketama-style hash ring. Requests with the same key go to the same server,
+// and adding or removing a server only moves the keys that land on its
+// points. Keys that land on an unhealthy server go on to the next healthy
+// server around the ring.
+type ConsistentHashLoadBalancer struct {
+	mu              sync.Mutex
+	health          HealthChecker
+	key             hashKey
+	upstreamServers []entity.UpstreamServer
+	ring            []ringPoint
+}
+
+func NewConsistentHashLoadBalancer(upstreamServers []entity.UpstreamServer, key string, health HealthChecker) (LoadBalancerHandler, error) {
+	parsed, err := parseHashKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &ConsistentHashLoadBalancer{
+		health:          health,
+		key:             parsed,
+		upstreamServers: upstreamServers,
+	}
+	l.buildRing()
+	return l, nil
+}
+
+func (l *ConsistentHashLoadBalancer) SelectServer(ctx RequestContext) (entity.UpstreamServer, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.ring) == 0 {
+		return entity.UpstreamServer{}, errors.New("no upstream servers")
+	}
+
+	hash := ketamaHash(l.key.value(ctx))
+	i := sort.Search(len(l.ring), func(i int) bool {
+		return l.ring[i].hash >= hash
+	})
+	for n := 0; n < len(l.ring); n++ {
+		server := l.upstreamServers[l.ring[(i+n)%len(l.ring)].server]
+		if available(l.health, ctx, server) {
+			return server, nil
+		}
+	}
+	return entity.UpstreamServer{}, errors.New("no healthy upstream servers")
+}
+
+// Done is a no-op: the choice depends only on the request.
+func (l *ConsistentHashLoadBalancer) Done(server entity.UpstreamServer) {}
+
+func (l *ConsistentHashLoadBalancer) AddServer(server entity.UpstreamServer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.upstreamServers = append(l.upstreamServers, server)
+	l.buildRing()
+	return nil
+}
+
+func (l *ConsistentHashLoadBalancer) RemoveServer(server entity.UpstreamServer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, s := range l.upstreamServers {
+		if s == server {
+			l.upstreamServers = append(l.upstreamServers[:i], l.upstreamServers[i+1:]...)
+			l.buildRing()
+			return nil
+		}
+	}
+	return nil
+}
+
+// buildRing places every server's points on the ring, in proportion to its
+// weight. Points are derived from the server's address only, so a server
+// lands on the same points whatever else is configured.
+func (l *ConsistentHashLoadBalancer) buildRing() {
+	l.ring = l.ring[:0]
+	for i, server := range l.upstreamServers {
+		for j := 0; j < pointsPerServer/4*serverWeight(server); j++ {
+			digest := md5.Sum([]byte(server.URL.Host + "-" + strconv.Itoa(j)))
+			for k := 0; k < 4; k++ {
+				l.ring = append(l.ring, ringPoint{
+					hash:   binary.LittleEndian.Uint32(digest[k*4:]),
+					server: i,
+				})
+			}
+		}
+	}
+	sort.Slice(l.ring, func(i, j int) bool {
+		return l.ring[i].hash < l.ring[j].hash
+	})
+}
+
+func ketamaHash(key string) uint32 {
+	digest := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(digest[:4])
+}
+
+// hashKey says which part of a request the consistent hash is computed over.
+type hashKey struct {
+	source string
+	name   string
+}
+
+// parseHashKey parses server.hash_key: "ip", "path", "header:<name>" or
+// "cookie:<name>".
+func parseHashKey(key string) (hashKey, error) {
+	source, name, _ := strings.Cut(key, ":")
+	switch source {
+	case "ip", "path":
+		if name == "" {
+			return hashKey{source: source}, nil
+		}
+	case "header", "cookie":
+		if name != "" {
+			return hashKey{source: source, name: name}, nil
+		}
+	}
+	return hashKey{}, fmt.Errorf("invalid hash key %q", key)
+}
+
+// value extracts the key from a request. Requests that lack the header or
+// cookie fall back to the client IP, so they still stick to one server.
+func (k hashKey) value(ctx RequestContext) string {
+	var value string
+	switch k.source {
+	case "path":
+		value, _, _ = strings.Cut(ctx.Request.Path, "?")
+	case "header":
+		value = ctx.Request.Headers.Get(k.name)
+	case "cookie":
+		value = cookieValue(ctx.Request.Headers, k.name)
+	}
+	if value == "" {
+		return ctx.ClientIP
+	}
+	return value
+}
+
+// cookieValue returns the value of the named cookie sent in the Cookie
+// headers, or "" if there is none.
+func cookieValue(headers entity.Header, name string) string {
+	for _, field := range headers.Values("Cookie") {
+		for _, pair := range strings.Split(field, ";") {
+			cookieName, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if found && cookieName == name {
+				return strings.Trim(value, `"`)
+			}
+		}
+	}
+	return ""
+}
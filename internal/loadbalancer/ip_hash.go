@@ -0,0 +1,97 @@
+//go:build linux
+
+package loadbalancer
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+
+	"github.com/stanleydv12/ginx/internal/entity"
+)
+
+// maxRehashes bounds how often ip_hash rehashes a client whose server is
+// unhealthy before it scans for any healthy server.
+const maxRehashes = 20
+
+// IPHashLoadBalancer sends every request from the same client IP to the same
+// server, as long as the set of servers does not change. Clients are spread
+// in proportion to the servers' weights. Clients of an unhealthy server are
+// rehashed, so they move together to another one.
+type IPHashLoadBalancer struct {
+	mu              sync.Mutex
+	health          HealthChecker
+	upstreamServers []entity.UpstreamServer
+}
+
+func NewIPHashLoadBalancer(upstreamServers []entity.UpstreamServer, health HealthChecker) LoadBalancerHandler {
+	return &IPHashLoadBalancer{
+		health:          health,
+		upstreamServers: upstreamServers,
+	}
+}
+
+func (l *IPHashLoadBalancer) SelectServer(ctx RequestContext) (entity.UpstreamServer, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.upstreamServers) == 0 {
+		return entity.UpstreamServer{}, errors.New("no upstream servers")
+	}
+
+	total := 0
+	for _, server := range l.upstreamServers {
+		total += serverWeight(server)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(ctx.ClientIP))
+	for i := 0; i < maxRehashes; i++ {
+		if server := l.serverAt(int(h.Sum32() % uint32(total))); available(l.health, ctx, server) {
+			return server, nil
+		}
+		h.Write([]byte{byte(i)})
+	}
+
+	for _, server := range l.upstreamServers {
+		if available(l.health, ctx, server) {
+			return server, nil
+		}
+	}
+	return entity.UpstreamServer{}, errors.New("no healthy upstream servers")
+}
+
+// serverAt returns the server owning point on the line of all servers laid
+// end to end, each as long as its weight.
+func (l *IPHashLoadBalancer) serverAt(point int) entity.UpstreamServer {
+	for _, server := range l.upstreamServers {
+		if point -= serverWeight(server); point < 0 {
+			return server
+		}
+	}
+	return l.upstreamServers[len(l.upstreamServers)-1]
+}
+
+// Done is a no-op: the choice depends only on the client.
+func (l *IPHashLoadBalancer) Done(server entity.UpstreamServer) {}
+
+func (l *IPHashLoadBalancer) AddServer(server entity.UpstreamServer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.upstreamServers = append(l.upstreamServers, server)
+	return nil
+}
+
+func (l *IPHashLoadBalancer) RemoveServer(server entity.UpstreamServer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, s := range l.upstreamServers {
+		if s == server {
+			l.upstreamServers = append(l.upstreamServers[:i], l.upstreamServers[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+//go:build linux
+
+package loadbalancer
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/stanleydv12/ginx/internal/entity"
+)
+
+// LeastConnectionsLoadBalancer sends each request to the healthy server with
+// the fewest requests in flight relative to its weight, going round-robin
+// among servers that tie.
+type LeastConnectionsLoadBalancer struct {
+	mu              sync.Mutex
+	health          HealthChecker
+	nextServer      int
+	upstreamServers []entity.UpstreamServer
+	// active counts the requests in flight per upstream server.
+	active map[entity.UpstreamServer]int
+}
+
+func NewLeastConnectionsLoadBalancer(upstreamServers []entity.UpstreamServer, health HealthChecker) LoadBalancerHandler {
+	return &LeastConnectionsLoadBalancer{
+		health:          health,
+		upstreamServers: upstreamServers,
+		active:          make(map[entity.UpstreamServer]int),
+	}
+}
+
+func (l *LeastConnectionsLoadBalancer) SelectServer(ctx RequestContext) (entity.UpstreamServer, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.upstreamServers) == 0 {
+		return entity.UpstreamServer{}, errors.New("no upstream servers")
+	}
+
+	// Start scanning after the last pick so ties are spread evenly.
+	best := -1
+	for i := range l.upstreamServers {
+		index := (l.nextServer + i) % len(l.upstreamServers)
+		if !available(l.health, ctx, l.upstreamServers[index]) {
+			continue
+		}
+		if best < 0 || l.less(l.upstreamServers[index], l.upstreamServers[best]) {
+			best = index
+		}
+	}
+	if best < 0 {
+		return entity.UpstreamServer{}, errors.New("no healthy upstream servers")
+	}
+
+	server := l.upstreamServers[best]
+	l.active[server]++
+	l.nextServer = (best + 1) % len(l.upstreamServers)
+	return server, nil
+}
+
+// less reports whether a is less loaded than b, comparing requests in flight
+// per unit of weight.
+func (l *LeastConnectionsLoadBalancer) less(a, b entity.UpstreamServer) bool {
+	return l.active[a]*serverWeight(b) < l.active[b]*serverWeight(a)
+}
+
+func (l *LeastConnectionsLoadBalancer) Done(server entity.UpstreamServer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[server] > 0 {
+		l.active[server]--
+	}
+}
+
+func (l *LeastConnectionsLoadBalancer) AddServer(server entity.UpstreamServer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.upstreamServers = append(l.upstreamServers, server)
+	return nil
+}
+
+func (l *LeastConnectionsLoadBalancer) RemoveServer(server entity.UpstreamServer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, s := range l.upstreamServers {
+		if s == server {
+			l.upstreamServers = append(l.upstreamServers[:i], l.upstreamServers[i+1:]...)
+			delete(l.active, server)
+			if l.nextServer >= len(l.upstreamServers) {
+				l.nextServer = 0
+			}
+			return nil
+		}
+	}
+	return nil
+}
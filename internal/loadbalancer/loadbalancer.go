@@ -1,75 +1,83 @@
 //go:build linux
 
+// Package loadbalancer picks the upstream server of a group for each
+// request. A group's balancer is shared by all workers, so every balancer
+// guards its state with its own mutex.
 package loadbalancer
 
 import (
 	"fmt"
-	"net"
-	"net/url"
-	"strings"
+	"slices"
 
-	"github.com/stanleydv12/ginx/internal/config"
 	"github.com/stanleydv12/ginx/internal/entity"
-	"github.com/stanleydv12/ginx/pkg/logger"
 )
 
+// RequestContext is what a balancer may look at to pick a server for a
+// request.
+type RequestContext struct {
+	// ClientIP is the address of the client, after trusted proxies in
+	// X-Forwarded-For have been taken into account.
+	ClientIP string
+	Request  entity.HTTPRequest
+	// Tried lists the servers the request has already failed on, so that a
+	// retry goes somewhere else.
+	Tried []entity.UpstreamServer
+}
+
 type LoadBalancerHandler interface {
-	SelectServer() (entity.UpstreamServer, error)
+	SelectServer(ctx RequestContext) (entity.UpstreamServer, error)
+	// Done reports that a request sent to a server returned by SelectServer
+	// has finished, whether it succeeded or not.
+	Done(server entity.UpstreamServer)
 	AddServer(server entity.UpstreamServer) error
 	RemoveServer(server entity.UpstreamServer) error
 }
 
-func NewLoadBalancer(cfg *config.ServerConfig) (LoadBalancerHandler, error) {
-	upstreamServers := []entity.UpstreamServer{}
-
-	for _, server := range cfg.Server.UpstreamServers {
-
-		// Ensure the URL has a scheme
-		if !strings.Contains(server, "://") {
-			server = "http://" + server
-		}
+// HealthChecker tells a balancer whether a server may receive requests.
+type HealthChecker interface {
+	Healthy(server entity.UpstreamServer) bool
+}
 
-		url, err := url.Parse(server)
-		if err != nil {
-			return nil, err
+// NewLoadBalancer creates the balancer named algorithm over upstreamServers;
+// hashKey is what consistent_hash hashes. It skips the servers health reports
+// as unhealthy; health may be nil.
+func NewLoadBalancer(algorithm string, hashKey string, upstreamServers []entity.UpstreamServer, health HealthChecker) (LoadBalancerHandler, error) {
+	for _, server := range upstreamServers {
+		if server.Backup && algorithm != "round_robin" {
+			return nil, fmt.Errorf("backup server %s requires the round_robin load balancer", server.URL)
 		}
+	}
 
-		// Validate host
-        if url.Host == "" {
-            return nil, fmt.Errorf("missing host in URL: %s", server)
-        }
+	switch algorithm {
+	case "round_robin":
+		return NewRoundRobinLoadBalancer(upstreamServers, health), nil
+	case "least_connections":
+		return NewLeastConnectionsLoadBalancer(upstreamServers, health), nil
+	case "ip_hash":
+		return NewIPHashLoadBalancer(upstreamServers, health), nil
+	case "consistent_hash":
+		return NewConsistentHashLoadBalancer(upstreamServers, hashKey, health)
+	default:
+		return nil, fmt.Errorf("unsupported load balancer type: %s", algorithm)
+	}
+}
 
-        // Only try to resolve if it's not an IP address
-        host := url.Hostname()
-        if net.ParseIP(host) == nil {
-            logger.Info("Resolving hostname", "host", host)
-            resolvedIPs, err := net.LookupHost(host)
-            if err != nil {
-                logger.Error("Failed to resolve hostname", "host", host, "error", err)
-                return nil, fmt.Errorf("failed to resolve %s: %v", host, err)
-            }
-            if len(resolvedIPs) == 0 {
-                return nil, fmt.Errorf("no IP addresses found for %s", host)
-            }
-            // Replace host with the first resolved IP, keeping the original port
-            if url.Port() != "" {
-                url.Host = net.JoinHostPort(resolvedIPs[0], url.Port())
-            } else {
-                url.Host = resolvedIPs[0]
-            }
-            logger.Debug("Resolved hostname", "host", host, "ip", resolvedIPs[0])
-        }
+// isHealthy reports whether server may receive requests.
+func isHealthy(health HealthChecker, server entity.UpstreamServer) bool {
+	return health == nil || health.Healthy(server)
+}
 
-		upstreamServers = append(upstreamServers, entity.UpstreamServer{
-			URL: url,
-		})
+// available reports whether server may receive the request: it is healthy
+// and the request has not already failed on it.
+func available(health HealthChecker, ctx RequestContext, server entity.UpstreamServer) bool {
+	return isHealthy(health, server) && !slices.Contains(ctx.Tried, server)
+}
 
-		logger.Info("Added upstream server", "url", url)
-	}
-	switch cfg.Server.LoadBalancer {
-	case "round_robin":
-		return NewRoundRobinLoadBalancer(0, upstreamServers), nil
-	default:
-		return nil, fmt.Errorf("unsupported load balancer type: %s", cfg.Server.LoadBalancer)
+// serverWeight returns the configured weight of server, treating servers
+// added without one as weight 1.
+func serverWeight(server entity.UpstreamServer) int {
+	if server.Weight <= 0 {
+		return 1
 	}
+	return server.Weight
 }
@@ -0,0 +1,37 @@
+//go:build linux
+
+package loadbalancer
+
+import "fmt"
+
+// LoadBalancerRegistry holds the load balancers of the upstream groups by
+// name.
+type LoadBalancerRegistry interface {
+	// Register adds the balancer of the named group.
+	Register(name string, loadBalancer LoadBalancerHandler) error
+	// Get returns the balancer of the named group.
+	Get(name string) (LoadBalancerHandler, bool)
+}
+
+// Registry is filled in before the server starts and only read afterwards,
+// so the workers share it without a lock.
+type Registry struct {
+	balancers map[string]LoadBalancerHandler
+}
+
+func NewRegistry() LoadBalancerRegistry {
+	return &Registry{balancers: make(map[string]LoadBalancerHandler)}
+}
+
+func (r *Registry) Register(name string, loadBalancer LoadBalancerHandler) error {
+	if _, exists := r.balancers[name]; exists {
+		return fmt.Errorf("upstream %s is already registered", name)
+	}
+	r.balancers[name] = loadBalancer
+	return nil
+}
+
+func (r *Registry) Get(name string) (LoadBalancerHandler, bool) {
+	loadBalancer, exists := r.balancers[name]
+	return loadBalancer, exists
+}
@@ -4,43 +4,107 @@ package loadbalancer
 
 import (
 	"errors"
+	"sync"
+
 	"github.com/stanleydv12/ginx/internal/entity"
 )
 
+// weightedPeer is a server together with its smooth round robin state.
+type weightedPeer struct {
+	server        entity.UpstreamServer
+	currentWeight int
+}
+
+// RoundRobinLoadBalancer is nginx's smooth weighted round robin, which
+// spreads the picks of a heavier server out rather than sending them in one
+// burst. Backup servers are only used when no primary server is healthy.
 type RoundRobinLoadBalancer struct {
-	currentServer int
-	upstreamServers []entity.UpstreamServer	
+	mu      sync.Mutex
+	health  HealthChecker
+	primary []*weightedPeer
+	backup  []*weightedPeer
 }
 
-func NewRoundRobinLoadBalancer(currentServer int, upstreamServers []entity.UpstreamServer) LoadBalancerHandler {
-	return &RoundRobinLoadBalancer{
-		currentServer: currentServer,
-		upstreamServers: upstreamServers,
+func NewRoundRobinLoadBalancer(upstreamServers []entity.UpstreamServer, health HealthChecker) LoadBalancerHandler {
+	l := &RoundRobinLoadBalancer{health: health}
+	for _, server := range upstreamServers {
+		l.addPeer(server)
 	}
+	return l
 }
 
-func (l *RoundRobinLoadBalancer) SelectServer() (entity.UpstreamServer, error) {
-	if len(l.upstreamServers) == 0 {
+func (l *RoundRobinLoadBalancer) SelectServer(ctx RequestContext) (entity.UpstreamServer, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, peers := range [][]*weightedPeer{l.primary, l.backup} {
+		if peer := l.smoothWeighted(ctx, peers); peer != nil {
+			return peer.server, nil
+		}
+	}
+	if len(l.primary) == 0 && len(l.backup) == 0 {
 		return entity.UpstreamServer{}, errors.New("no upstream servers")
 	}
-	
-	server := l.upstreamServers[l.currentServer]
-	l.currentServer = (l.currentServer + 1) % len(l.upstreamServers)
-	return server, nil
+	return entity.UpstreamServer{}, errors.New("no healthy upstream servers")
+}
+
+// smoothWeighted picks the next peer of a group that is available for the
+// request, or nil if there is none. Every pick raises each peer's current
+// weight by its weight and takes the highest, which then drops by the total.
+func (l *RoundRobinLoadBalancer) smoothWeighted(ctx RequestContext, peers []*weightedPeer) *weightedPeer {
+	var best *weightedPeer
+	total := 0
+	for _, peer := range peers {
+		if !available(l.health, ctx, peer.server) {
+			continue
+		}
+		weight := serverWeight(peer.server)
+		peer.currentWeight += weight
+		total += weight
+		if best == nil || peer.currentWeight > best.currentWeight {
+			best = peer
+		}
+	}
+	if best != nil {
+		best.currentWeight -= total
+	}
+	return best
 }
 
+// Done is a no-op: round robin does not look at requests in flight.
+func (l *RoundRobinLoadBalancer) Done(server entity.UpstreamServer) {}
+
 func (l *RoundRobinLoadBalancer) AddServer(server entity.UpstreamServer) error {
-	l.upstreamServers = append(l.upstreamServers, server)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.addPeer(server)
 	return nil
 }
 
-func (l *RoundRobinLoadBalancer) RemoveServer(server entity.UpstreamServer) error {
-	for i, s := range l.upstreamServers {
-		if s == server {
-			l.upstreamServers = append(l.upstreamServers[:i], l.upstreamServers[i+1:]...)
-			return nil
-		}
+func (l *RoundRobinLoadBalancer) addPeer(server entity.UpstreamServer) {
+	peer := &weightedPeer{server: server}
+	if server.Backup {
+		l.backup = append(l.backup, peer)
+	} else {
+		l.primary = append(l.primary, peer)
 	}
+}
+
+func (l *RoundRobinLoadBalancer) RemoveServer(server entity.UpstreamServer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.primary = removePeer(l.primary, server)
+	l.backup = removePeer(l.backup, server)
 	return nil
 }
 
+func removePeer(peers []*weightedPeer, server entity.UpstreamServer) []*weightedPeer {
+	for i, peer := range peers {
+		if peer.server == server {
+			return append(peers[:i], peers[i+1:]...)
+		}
+	}
+	return peers
+}
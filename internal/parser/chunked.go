@@ -0,0 +1,186 @@
+//go:build linux
+
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/stanleydv12/ginx/internal/entity"
+)
+
+// maxChunkLineSize bounds a chunk-size line (including extensions) or a
+// trailer line so a peer cannot make us buffer without limit.
+const maxChunkLineSize = 4096
+
+type chunkState int
+
+const (
+	chunkStateSize chunkState = iota
+	chunkStateData
+	chunkStateDataEnd
+	chunkStateTrailer
+	chunkStateDone
+)
+
+// ChunkedDecoder incrementally decodes a Transfer-Encoding: chunked body. It
+// can be fed the body in arbitrarily small pieces and keeps track of where
+// the body ends, so it can also be used to find the end of a chunked body
+// that is relayed verbatim.
+type ChunkedDecoder struct {
+	state     chunkState
+	remaining int64
+	line      []byte
+}
+
+func NewChunkedDecoder() *ChunkedDecoder {
+	return &ChunkedDecoder{}
+}
+
+// Done reports whether the terminating chunk and trailer section have been
+// consumed.
+func (d *ChunkedDecoder) Done() bool {
+	return d.state == chunkStateDone
+}
+
+// Next consumes chunked input from data up to and including the next run of
+// body bytes, which it reports as data[start:end] without copying. It returns
+// how many bytes of data were consumed; an empty run means data was exhausted
+// or the body ended before any further body bytes.
+func (d *ChunkedDecoder) Next(data []byte) (n, start, end int, err error) {
+	i := 0
+	for i < len(data) && d.state != chunkStateDone {
+		if d.state == chunkStateData {
+			k := int64(len(data) - i)
+			if k > d.remaining {
+				k = d.remaining
+			}
+			start, end = i, i+int(k)
+			d.remaining -= k
+			if d.remaining == 0 {
+				d.state = chunkStateDataEnd
+			}
+			return end, start, end, nil
+		}
+
+		// Every other state consumes a CRLF-terminated line.
+		idx := bytes.IndexByte(data[i:], '\n')
+		if idx == -1 {
+			d.line = append(d.line, data[i:]...)
+			i = len(data)
+			if len(d.line) > maxChunkLineSize {
+				return i, i, i, fmt.Errorf("chunk line exceeds %d bytes", maxChunkLineSize)
+			}
+			break
+		}
+
+		line := append(d.line, data[i:i+idx]...)
+		i += idx + 1
+		d.line = d.line[:0]
+		if len(line) > maxChunkLineSize {
+			return i, i, i, fmt.Errorf("chunk line exceeds %d bytes", maxChunkLineSize)
+		}
+		// The body is relayed with its framing as received, so a line
+		// that a stricter peer would split differently must not pass.
+		if !bytes.HasSuffix(line, []byte("\r")) {
+			return i, i, i, fmt.Errorf("chunk line not terminated by CRLF")
+		}
+		line = line[:len(line)-1]
+
+		switch d.state {
+		case chunkStateSize:
+			size, err := parseChunkSize(line)
+			if err != nil {
+				return i, i, i, err
+			}
+			if size == 0 {
+				d.state = chunkStateTrailer
+			} else {
+				d.remaining = size
+				d.state = chunkStateData
+			}
+		case chunkStateDataEnd:
+			if len(line) != 0 {
+				return i, i, i, fmt.Errorf("missing CRLF after chunk data")
+			}
+			d.state = chunkStateSize
+		case chunkStateTrailer:
+			if len(line) == 0 {
+				d.state = chunkStateDone
+				break
+			}
+			if !bytes.Contains(line, []byte(":")) {
+				return i, i, i, fmt.Errorf("malformed trailer field: %q", line)
+			}
+		}
+	}
+
+	return i, i, i, nil
+}
+
+// parseChunkSize parses a chunk-size line of the form
+// "1a;name=value;flag", returning the size. The size must be plain hex
+// digits, with no sign, prefix or surrounding whitespace.
+func parseChunkSize(line []byte) (int64, error) {
+	sizeText, extension, _ := strings.Cut(string(line), ";")
+	if sizeText == "" {
+		return 0, fmt.Errorf("missing chunk size")
+	}
+	for i := 0; i < len(sizeText); i++ {
+		if !isHexDigit(sizeText[i]) {
+			return 0, fmt.Errorf("invalid chunk size: %q", sizeText)
+		}
+	}
+
+	size, err := strconv.ParseInt(sizeText, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chunk size: %q", sizeText)
+	}
+
+	for _, ext := range strings.Split(extension, ";") {
+		name, _, _ := strings.Cut(ext, "=")
+		if extension != "" && strings.TrimSpace(name) == "" {
+			return 0, fmt.Errorf("malformed chunk extension: %q", extension)
+		}
+	}
+
+	return size, nil
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// AppendChunk appends data framed as a single chunk to dst. Empty data is
+// skipped, since a zero-length chunk would terminate the body.
+func AppendChunk(dst, data []byte) []byte {
+	if len(data) == 0 {
+		return dst
+	}
+	dst = strconv.AppendInt(dst, int64(len(data)), 16)
+	dst = append(dst, '\r', '\n')
+	dst = append(dst, data...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendLastChunk appends the terminating zero-length chunk, followed by the
+// given trailer fields, to dst.
+func AppendLastChunk(dst []byte, trailers entity.Header) []byte {
+	dst = append(dst, "0\r\n"...)
+	for _, field := range trailers.Fields() {
+		dst = append(dst, field.Name...)
+		dst = append(dst, ": "...)
+		dst = append(dst, field.Value...)
+		dst = append(dst, '\r', '\n')
+	}
+	return append(dst, '\r', '\n')
+}
+
+// IsChunked reports whether a Transfer-Encoding header value ends with the
+// chunked coding, which then determines the message framing.
+func IsChunked(transferEncoding string) bool {
+	codings := strings.Split(transferEncoding, ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
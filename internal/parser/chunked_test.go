@@ -0,0 +1,146 @@
+//go:build linux
+
+package parser
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stanleydv12/ginx/internal/entity"
+)
+
+// splits returns the ways data is cut up in the tests: whole, in two at
+// every offset, and one byte at a time.
+func splits(data []byte) [][][]byte {
+	ways := [][][]byte{{data}}
+	for i := 1; i < len(data); i++ {
+		ways = append(ways, [][]byte{data[:i], data[i:]})
+	}
+	bytewise := make([][]byte, 0, len(data))
+	for i := range data {
+		bytewise = append(bytewise, data[i:i+1])
+	}
+	return append(ways, bytewise)
+}
+
+// decodeChunked feeds pieces to a fresh decoder and returns the decoded body
+// and how many bytes the chunked body took, stopping at the end of the body.
+func decodeChunked(t *testing.T, pieces [][]byte) ([]byte, int, bool, error) {
+	t.Helper()
+
+	d := NewChunkedDecoder()
+	var body []byte
+	consumed := 0
+	for _, piece := range pieces {
+		for len(piece) > 0 && !d.Done() {
+			n, start, end, err := d.Next(piece)
+			if err != nil {
+				return body, consumed + n, false, err
+			}
+			if n == 0 {
+				t.Fatalf("Next consumed nothing from %q", piece)
+			}
+			body = append(body, piece[start:end]...)
+			consumed += n
+			piece = piece[n:]
+		}
+	}
+	return body, consumed, d.Done(), nil
+}
+
+func TestChunkedDecoder(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		body  string
+	}{
+		{"single chunk", "5\r\nhello\r\n0\r\n\r\n", "hello"},
+		{"several chunks", "5\r\nhello\r\n1\r\n \r\n5\r\nworld\r\n0\r\n\r\n", "hello world"},
+		{"upper case hex", "A\r\n0123456789\r\n0\r\n\r\n", "0123456789"},
+		{"leading zeros", "005\r\nhello\r\n000\r\n\r\n", "hello"},
+		{"empty body", "0\r\n\r\n", ""},
+		{"extensions", "5;name=value;flag\r\nhello\r\n0;last\r\n\r\n", "hello"},
+		{"quoted extension", "5;name=\"a b\"\r\nhello\r\n0\r\n\r\n", "hello"},
+		{"trailers", "5\r\nhello\r\n0\r\nX-Checksum: abc\r\nX-Other:1\r\n\r\n", "hello"},
+		{"body with CRLF", "7\r\na\r\nb\r\nc\r\n0\r\n\r\n", "a\r\nb\r\nc"},
+	}
+	for _, tt := range tests {
+		// Bytes after the body belong to the next message and must be
+		// left alone.
+		input := []byte(tt.input + "GET / HTTP/1.1\r\n")
+		for _, pieces := range splits(input) {
+			body, consumed, done, err := decodeChunked(t, pieces)
+			if err != nil {
+				t.Fatalf("%s: split %d: unexpected error: %v", tt.name, len(pieces[0]), err)
+			}
+			if !done {
+				t.Fatalf("%s: split %d: body not complete", tt.name, len(pieces[0]))
+			}
+			if string(body) != tt.body {
+				t.Fatalf("%s: split %d: body %q, want %q", tt.name, len(pieces[0]), body, tt.body)
+			}
+			if consumed != len(tt.input) {
+				t.Fatalf("%s: split %d: consumed %d bytes, want %d", tt.name, len(pieces[0]), consumed, len(tt.input))
+			}
+		}
+	}
+}
+
+func TestChunkedDecoderRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"bare LF after size", "5\nhello\r\n0\r\n\r\n"},
+		{"bare LF after data", "5\r\nhello\n0\r\n\r\n"},
+		{"bare LF after last chunk", "5\r\nhello\r\n0\n\r\n"},
+		{"bare LF ending trailers", "5\r\nhello\r\n0\r\n\n"},
+		{"bare LF after trailer", "5\r\nhello\r\n0\r\nX-A: 1\n\r\n"},
+		{"plus sign", "+5\r\nhello\r\n0\r\n\r\n"},
+		{"minus sign", "-5\r\nhello\r\n0\r\n\r\n"},
+		{"hex prefix", "0x5\r\nhello\r\n0\r\n\r\n"},
+		{"leading space", " 5\r\nhello\r\n0\r\n\r\n"},
+		{"trailing space", "5 \r\nhello\r\n0\r\n\r\n"},
+		{"tab before extension", "5\t;a=b\r\nhello\r\n0\r\n\r\n"},
+		{"missing size", "\r\nhello\r\n0\r\n\r\n"},
+		{"extension without size", ";a=b\r\nhello\r\n0\r\n\r\n"},
+		{"extension without name", "5;=b\r\nhello\r\n0\r\n\r\n"},
+		{"size overflow", "10000000000000000\r\nhello\r\n0\r\n\r\n"},
+		{"data longer than size", "5\r\nhelloX\r\n0\r\n\r\n"},
+		{"malformed trailer", "5\r\nhello\r\n0\r\nno colon\r\n\r\n"},
+		{"oversize size line", "5;" + strings.Repeat("a", maxChunkLineSize) + "\r\nhello\r\n0\r\n\r\n"},
+		{"oversize unterminated line", "5;" + strings.Repeat("a", maxChunkLineSize)},
+		{"oversize trailer", "0\r\nX-A: " + strings.Repeat("a", maxChunkLineSize) + "\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		for _, pieces := range splits([]byte(tt.input)) {
+			_, _, done, err := decodeChunked(t, pieces)
+			if err == nil {
+				t.Fatalf("%s: split %d: want an error, got done=%v", tt.name, len(pieces[0]), done)
+			}
+		}
+	}
+}
+
+func TestAppendChunk(t *testing.T) {
+	var framed []byte
+	framed = AppendChunk(framed, []byte("hello world, this is a chunk"))
+	framed = AppendChunk(framed, nil)
+	framed = AppendChunk(framed, []byte("!"))
+	framed = AppendLastChunk(framed, entity.Header{})
+
+	body, consumed, done, err := decodeChunked(t, [][]byte{framed})
+	if err != nil || !done {
+		t.Fatalf("decoding %q: done=%v err=%v", framed, done, err)
+	}
+	if want := "hello world, this is a chunk!"; string(body) != want {
+		t.Fatalf("body %q, want %q", body, want)
+	}
+	if consumed != len(framed) {
+		t.Fatalf("consumed %d bytes, want %d", consumed, len(framed))
+	}
+	if !bytes.HasPrefix(framed, []byte("1c\r\n")) {
+		t.Fatalf("chunk size not in lower case hex: %q", framed)
+	}
+}
@@ -1,15 +1,16 @@
 //go:build linux
+
 package parser
 
 import (
-    "bufio"
-    "bytes"
-    "fmt"
-    "io"
-    "net/textproto"
-    "strconv"
-    "strings"
-    "github.com/stanleydv12/ginx/internal/entity"
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/stanleydv12/ginx/internal/entity"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -22,92 +23,127 @@ const (
 	HTTPMethodPatch   = "PATCH"
 
 	HTTPProtocolHTTP11 = "HTTP/1.1"
+)
 
-	HTTPStatusCodeOK = 200
-	HTTPStatusCodeNotFound = 404
-	HTTPStatusCodeMethodNotAllowed = 405
-	HTTPStatusCodeInternalServerError = 500
-
-	HTTPStatusTextOK = "OK"
-	HTTPStatusTextNotFound = "Not Found"
-	HTTPStatusTextMethodNotAllowed = "Method Not Allowed"
-	HTTPStatusTextInternalServerError = "Internal Server Error"
+const (
+	// BodyUntilClose marks a message body delimited by the connection closing.
+	BodyUntilClose int64 = -1
+	// BodyChunked marks a message body framed with Transfer-Encoding: chunked.
+	BodyChunked int64 = -2
 )
 
+var headerTerminator = []byte("\r\n\r\n")
+
 type HTTPParser struct{}
 
 func NewHTTPParser() HTTPParser {
-    return HTTPParser{}
+	return HTTPParser{}
+}
+
+// parseRequestHead reads the request line and headers from reader, leaving
+// it positioned at the first body byte.
+func (p *HTTPParser) parseRequestHead(reader *bufio.Reader) (entity.HTTPRequest, error) {
+	// Read request line
+	line, _, err := reader.ReadLine()
+	if err != nil {
+		return entity.HTTPRequest{}, err
+	}
+
+	// Parse request line
+	parts := strings.SplitN(string(line), " ", 3)
+	if len(parts) < 3 {
+		return entity.HTTPRequest{}, fmt.Errorf("malformed HTTP request")
+	}
+
+	req := entity.HTTPRequest{
+		Method:   parts[0],
+		Path:     parts[1],
+		Protocol: parts[2],
+	}
+
+	// Parse headers
+	tp := textproto.NewReader(reader)
+	for {
+		header, err := tp.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entity.HTTPRequest{}, err
+		}
+		if header == "" {
+			break // End of headers
+		}
+
+		// Split header into key-value
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		req.Headers.Add(key, value)
+	}
+
+	return req, nil
+}
+
+// FindHeaderEnd returns the offset just past the blank line that terminates
+// the header block, or -1 if the block has not been fully received yet.
+func FindHeaderEnd(data []byte) int {
+	idx := bytes.Index(data, headerTerminator)
+	if idx == -1 {
+		return -1
+	}
+	return idx + len(headerTerminator)
+}
+
+// ParseHTTPRequestHeader parses a request line and header block without
+// touching the body, so the body can be streamed separately.
+func (p *HTTPParser) ParseHTTPRequestHeader(data []byte) (entity.HTTPRequest, error) {
+	end := FindHeaderEnd(data)
+	if end == -1 {
+		return entity.HTTPRequest{}, fmt.Errorf("incomplete HTTP request header")
+	}
+
+	return p.parseRequestHead(bufio.NewReader(bytes.NewReader(data[:end])))
+}
+
+// ContentLength returns the declared body length, or 0 if none was declared.
+// Repeated Content-Length fields must all agree. Each value must be plain
+// decimal digits: it is forwarded as received, and an upstream that reads a
+// sign differently would disagree with us on where the body ends.
+func ContentLength(headers entity.Header) (int64, error) {
+	var length int64 = -1
+	for _, cl := range headers.Values("Content-Length") {
+		digits := strings.TrimSpace(cl)
+		if digits == "" || strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }) != -1 {
+			return 0, fmt.Errorf("invalid Content-Length: %q", cl)
+		}
+		n, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid Content-Length: %q", cl)
+		}
+		if length != -1 && n != length {
+			return 0, fmt.Errorf("conflicting Content-Length values")
+		}
+		length = n
+	}
+	if length == -1 {
+		return 0, nil
+	}
+	return length, nil
 }
 
-func (p *HTTPParser) ParseHTTPRequest(data []byte) (entity.HTTPRequest, error) {
-    reader := bufio.NewReader(bytes.NewReader(data))
-    
-    // Read request line
-    line, _, err := reader.ReadLine()
-    if err != nil {
-        return entity.HTTPRequest{}, err
-    }
-    
-    // Parse request line
-    parts := strings.SplitN(string(line), " ", 3)
-    if len(parts) < 3 {
-        return entity.HTTPRequest{}, fmt.Errorf("malformed HTTP request")
-    }
-    
-    req := entity.HTTPRequest{
-        Method:   parts[0],
-        Path:     parts[1],
-        Protocol: parts[2],
-        Headers:  make(map[string]string),
-        Raw:      make([]byte, len(data)),
-    }
-    copy(req.Raw, data)
-    
-    // Parse headers
-    tp := textproto.NewReader(bufio.NewReader(reader))
-    for {
-        header, err := tp.ReadLine()
-        if err == io.EOF {
-            break
-        }
-        if err != nil {
-            return entity.HTTPRequest{}, err
-        }
-        if header == "" {
-            break // End of headers
-        }
-        
-        // Split header into key-value
-        parts := strings.SplitN(header, ":", 2)
-        if len(parts) != 2 {
-            continue
-        }
-        key := strings.TrimSpace(parts[0])
-        value := strings.TrimSpace(parts[1])
-        req.Headers[key] = value
-    }
-    
-    // Read body if Content-Length is present
-    if cl, ok := req.Headers["Content-Length"]; ok {
-        contentLength := 0
-        _, err := fmt.Sscanf(cl, "%d", &contentLength)
-        if err == nil && contentLength > 0 {
-            body := make([]byte, contentLength)
-            _, err := io.ReadFull(reader, body)
-            if err != nil {
-                return entity.HTTPRequest{}, err
-            }
-            req.Body = body
-        }
-    }
-    
-    return req, nil
+// transferEncoding returns the combined value of every Transfer-Encoding
+// field, or "" if there is none.
+func transferEncoding(headers entity.Header) string {
+	return strings.Join(headers.Values("Transfer-Encoding"), ", ")
 }
 
-func (p *HTTPParser) ParseHTTPResponse(data []byte) (entity.HTTPResponse, error) {
-	reader := bufio.NewReader(bytes.NewReader(data))
-	
+// parseResponseHead reads the status line and headers from reader, leaving
+// it positioned at the first body byte.
+func (p *HTTPParser) parseResponseHead(reader *bufio.Reader) (entity.HTTPResponse, error) {
 	// Read status line
 	statusLine, err := reader.ReadString('\n')
 	if err != nil {
@@ -115,11 +151,12 @@ func (p *HTTPParser) ParseHTTPResponse(data []byte) (entity.HTTPResponse, error)
 	}
 	statusLine = strings.TrimSpace(statusLine)
 
-	// Parse status line (e.g., "HTTP/1.1 200 OK")
+	// Parse status line (e.g., "HTTP/1.1 200 OK"); the reason phrase may be
+	// empty.
 	parts := strings.SplitN(statusLine, " ", 3)
-	if len(parts) < 3 {
+	if len(parts) < 2 {
 		return entity.HTTPResponse{}, fmt.Errorf("malformed status line: %s", statusLine)
-	}	
+	}
 
 	// Parse status code
 	statusCode, err := strconv.Atoi(parts[1])
@@ -128,11 +165,12 @@ func (p *HTTPParser) ParseHTTPResponse(data []byte) (entity.HTTPResponse, error)
 	}
 
 	response := entity.HTTPResponse{
+		Protocol:   parts[0],
 		StatusCode: statusCode,
-		Headers:   make(map[string]string),
-		Raw:       make([]byte, len(data)),
 	}
-	copy(response.Raw, data)
+	if len(parts) == 3 {
+		response.Reason = parts[2]
+	}
 
 	// Read headers
 	for {
@@ -140,8 +178,8 @@ func (p *HTTPParser) ParseHTTPResponse(data []byte) (entity.HTTPResponse, error)
 		if readErr != nil && readErr != io.EOF {
 			break
 		}
-			line = strings.TrimSpace(line)
-		
+		line = strings.TrimSpace(line)
+
 		// End of headers
 		if line == "" {
 			break
@@ -155,88 +193,107 @@ func (p *HTTPParser) ParseHTTPResponse(data []byte) (entity.HTTPResponse, error)
 
 		key := strings.TrimSpace(headerParts[0])
 		value := strings.TrimSpace(headerParts[1])
-		response.Headers[key] = value
-	}
-
-	// Read body if Content-Length is present
-	if contentLength, ok := response.Headers["Content-Length"]; ok {
-		length, err := strconv.Atoi(contentLength)
-		if err == nil && length > 0 {
-			body := make([]byte, length)
-			n, err := reader.Read(body)
-			if err != nil && err != io.EOF {
-				return entity.HTTPResponse{}, fmt.Errorf("failed to read response body: %v", err)
-			}
-			response.Body = body[:n]
+		response.Headers.Add(key, value)
+	}
+
+	return response, nil
+}
+
+// ParseHTTPResponseHeader parses a status line and header block without
+// touching the body, so the body can be streamed separately.
+func (p *HTTPParser) ParseHTTPResponseHeader(data []byte) (entity.HTTPResponse, error) {
+	end := FindHeaderEnd(data)
+	if end == -1 {
+		return entity.HTTPResponse{}, fmt.Errorf("incomplete HTTP response header")
+	}
+
+	return p.parseResponseHead(bufio.NewReader(bytes.NewReader(data[:end])))
+}
+
+// RequestBodyLength returns how many body bytes follow a request header, or
+// BodyChunked if the body uses chunked framing. Requests carrying both
+// Content-Length and Transfer-Encoding are rejected, since the two framings
+// can be used to smuggle requests past the proxy.
+func RequestBodyLength(req entity.HTTPRequest) (int64, error) {
+	if req.Headers.Has("Transfer-Encoding") {
+		te := transferEncoding(req.Headers)
+		if req.Headers.Has("Content-Length") {
+			return 0, fmt.Errorf("request has both Content-Length and Transfer-Encoding")
 		}
-	} else {
-		// If no Content-Length, read until EOF (for responses with Transfer-Encoding: chunked or connection close)
-		body, err := io.ReadAll(reader)
-		if err != nil && err != io.EOF {
-			return entity.HTTPResponse{}, fmt.Errorf("failed to read response body: %v", err)
+		if !IsChunked(te) {
+			return 0, fmt.Errorf("unsupported request Transfer-Encoding: %q", te)
 		}
-		response.Body = body
+		return BodyChunked, nil
 	}
+	return ContentLength(req.Headers)
+}
 
-	return response, nil
+// ResponseBodyLength returns how many body bytes follow a response header
+// sent in reply to a request with the given method, BodyChunked if the body
+// uses chunked framing, or BodyUntilClose if the body is delimited by the
+// upstream closing the connection.
+func ResponseBodyLength(method string, resp entity.HTTPResponse) (int64, error) {
+	if method == HTTPMethodHead || (resp.StatusCode >= 100 && resp.StatusCode < 200) ||
+		resp.StatusCode == 204 || resp.StatusCode == 304 {
+		return 0, nil
+	}
+	if resp.Headers.Has("Transfer-Encoding") {
+		if IsChunked(transferEncoding(resp.Headers)) {
+			return BodyChunked, nil
+		}
+		return BodyUntilClose, nil
+	}
+	if resp.Headers.Has("Content-Length") {
+		return ContentLength(resp.Headers)
+	}
+	return BodyUntilClose, nil
 }
 
 func (p *HTTPParser) RebuildRequest(req entity.HTTPRequest) []byte {
-    var buf bytes.Buffer
-    
-    // Write request line
-    buf.WriteString(fmt.Sprintf("%s %s %s\r\n", req.Method, req.Path, req.Protocol))
-    
-    // Write headers
-    for key, value := range req.Headers {
-        buf.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
-    }
-    
-    // End of headers
-    buf.WriteString("\r\n")
-    
-    // Write body if exists
-    if len(req.Body) > 0 {
-        buf.Write(req.Body)
-    }
-    
-    return buf.Bytes()
-}
+	var buf bytes.Buffer
 
+	// Write request line
+	buf.WriteString(fmt.Sprintf("%s %s %s\r\n", req.Method, req.Path, req.Protocol))
 
-func (p *HTTPParser) RebuildResponse(resp entity.HTTPResponse) []byte {
-    var buf bytes.Buffer
-    
-    // Write status line
-    buf.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\r\n", resp.StatusCode, HTTPStatusCode(resp.StatusCode)))
-    
-    // Write headers
-    for key, value := range resp.Headers {
-        buf.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
-    }
-    
-    // End of headers
-    buf.WriteString("\r\n")
-    
-    // Write body if exists
-    if len(resp.Body) > 0 {
-        buf.Write(resp.Body)
-    }
-    
-    return buf.Bytes()
+	// Write headers
+	for _, field := range req.Headers.Fields() {
+		buf.WriteString(fmt.Sprintf("%s: %s\r\n", field.Name, field.Value))
+	}
+
+	// End of headers
+	buf.WriteString("\r\n")
+
+	// Write body if exists
+	if len(req.Body) > 0 {
+		buf.Write(req.Body)
+	}
+
+	return buf.Bytes()
 }
 
-func HTTPStatusCode(statusCode int) string {
-	switch statusCode {
-	case HTTPStatusCodeOK:
-		return HTTPStatusTextOK
-	case HTTPStatusCodeNotFound:
-		return HTTPStatusTextNotFound
-	case HTTPStatusCodeMethodNotAllowed:
-		return HTTPStatusTextMethodNotAllowed
-	case HTTPStatusCodeInternalServerError:
-		return HTTPStatusTextInternalServerError
-	default:
-		return fmt.Sprintf("Unknown status code: %d", statusCode)
+func (p *HTTPParser) RebuildResponse(resp entity.HTTPResponse) []byte {
+	var buf bytes.Buffer
+
+	// Write status line, keeping the upstream's reason phrase when there is
+	// one
+	reason := resp.Reason
+	if reason == "" {
+		reason = statusText[resp.StatusCode]
+	}
+	buf.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\r\n", resp.StatusCode, reason))
+
+	// Write headers
+	for _, field := range resp.Headers.Fields() {
+		buf.WriteString(fmt.Sprintf("%s: %s\r\n", field.Name, field.Value))
 	}
+
+	// End of headers
+	buf.WriteString("\r\n")
+
+	// Write body if exists
+	if len(resp.Body) > 0 {
+		buf.Write(resp.Body)
+	}
+
+	return buf.Bytes()
 }
@@ -0,0 +1,280 @@
+//go:build linux
+
+package parser
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/stanleydv12/ginx/internal/entity"
+)
+
+// EventType identifies what a MessageParser found in the bytes it was fed.
+type EventType int
+
+const (
+	// EventNeedMore means every byte fed so far was consumed and the parser
+	// needs more input before it can report anything else.
+	EventNeedMore EventType = iota
+	// EventHeadersComplete means the start line and header block have been
+	// parsed and are available from Request or Response.
+	EventHeadersComplete
+	// EventBodyChunk reports a run of body bytes at data[Start:End]. For
+	// chunked bodies these are the decoded bytes, without chunk framing.
+	EventBodyChunk
+	// EventMessageComplete means the whole message, body included, has been
+	// consumed. Bytes after it belong to the next message.
+	EventMessageComplete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventNeedMore:
+		return "need_more"
+	case EventHeadersComplete:
+		return "headers_complete"
+	case EventBodyChunk:
+		return "body_chunk"
+	case EventMessageComplete:
+		return "message_complete"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
+// Event is reported by MessageParser.Feed. Start and End are offsets into the
+// slice passed to Feed.
+type Event struct {
+	Type  EventType
+	Start int
+	End   int
+}
+
+// ErrHeaderTooLarge is returned when a header block exceeds the parser's
+// size limit before it is complete.
+var ErrHeaderTooLarge = errors.New("header block too large")
+
+type messageKind int
+
+const (
+	messageRequest messageKind = iota
+	messageResponse
+)
+
+type messageState int
+
+const (
+	messageStateHeader messageState = iota
+	messageStateBody
+	messageStateComplete
+)
+
+// MessageParser incrementally parses one HTTP/1.x message at a time from
+// bytes that arrive piecemeal, as they do from an edge-triggered event loop.
+// Only the header block is buffered internally; body bytes are reported as
+// offsets into the caller's buffer so they can be relayed without copying.
+type MessageParser struct {
+	parser        HTTPParser
+	kind          messageKind
+	requestMethod string
+	maxHeaderSize int
+
+	state         messageState
+	header        []byte
+	request       entity.HTTPRequest
+	response      entity.HTTPResponse
+	bodyLength    int64
+	bodyRemaining int64
+	chunked       *ChunkedDecoder
+}
+
+// NewRequestParser returns a parser for requests whose header blocks may be
+// at most maxHeaderSize bytes.
+func NewRequestParser(maxHeaderSize int) *MessageParser {
+	return &MessageParser{
+		parser:        NewHTTPParser(),
+		kind:          messageRequest,
+		maxHeaderSize: maxHeaderSize,
+	}
+}
+
+// NewResponseParser returns a parser for the response to a request with the
+// given method, whose header blocks may be at most maxHeaderSize bytes.
+func NewResponseParser(requestMethod string, maxHeaderSize int) *MessageParser {
+	return &MessageParser{
+		parser:        NewHTTPParser(),
+		kind:          messageResponse,
+		requestMethod: requestMethod,
+		maxHeaderSize: maxHeaderSize,
+	}
+}
+
+// Reset prepares the parser for the next message on the same connection.
+func (p *MessageParser) Reset() {
+	p.state = messageStateHeader
+	p.header = p.header[:0]
+	p.request = entity.HTTPRequest{}
+	p.response = entity.HTTPResponse{}
+	p.bodyLength = 0
+	p.bodyRemaining = 0
+	p.chunked = nil
+}
+
+// Feed consumes bytes from data and reports the next event along with how
+// many bytes of data it consumed. Callers keep calling Feed with the
+// unconsumed remainder until it reports EventNeedMore or
+// EventMessageComplete; the latter is reported again, consuming nothing,
+// until Reset is called.
+func (p *MessageParser) Feed(data []byte) (Event, int, error) {
+	switch p.state {
+	case messageStateHeader:
+		return p.feedHeader(data)
+	case messageStateBody:
+		return p.feedBody(data)
+	default:
+		return Event{Type: EventMessageComplete}, 0, nil
+	}
+}
+
+// Finish tells the parser the peer closed the connection. It completes a
+// body delimited by the connection closing and fails for any message that
+// was cut short.
+func (p *MessageParser) Finish() error {
+	switch {
+	case p.state == messageStateComplete:
+		return nil
+	case p.state == messageStateBody && p.bodyLength == BodyUntilClose:
+		p.state = messageStateComplete
+		return nil
+	case p.state == messageStateHeader && len(p.header) == 0:
+		return errors.New("connection closed before a message was started")
+	case p.state == messageStateHeader:
+		return errors.New("connection closed before the header block was complete")
+	default:
+		return errors.New("connection closed before the end of the message body")
+	}
+}
+
+func (p *MessageParser) feedHeader(data []byte) (Event, int, error) {
+	// Resume the search a few bytes back in case the terminator straddles
+	// two reads.
+	searchFrom := len(p.header) - len(headerTerminator) + 1
+	if searchFrom < 0 {
+		searchFrom = 0
+	}
+	previous := len(p.header)
+	p.header = append(p.header, data...)
+
+	end := FindHeaderEnd(p.header[searchFrom:])
+	if end == -1 {
+		if len(p.header) > p.maxHeaderSize {
+			return Event{}, len(data), ErrHeaderTooLarge
+		}
+		return Event{Type: EventNeedMore}, len(data), nil
+	}
+	end += searchFrom
+	p.header = p.header[:end]
+	consumed := end - previous
+
+	if len(p.header) > p.maxHeaderSize {
+		return Event{}, consumed, ErrHeaderTooLarge
+	}
+
+	var err error
+	if p.kind == messageRequest {
+		p.request, err = p.parser.ParseHTTPRequestHeader(p.header)
+		if err == nil {
+			p.bodyLength, err = RequestBodyLength(p.request)
+		}
+	} else {
+		p.response, err = p.parser.ParseHTTPResponseHeader(p.header)
+		if err == nil {
+			p.bodyLength, err = ResponseBodyLength(p.requestMethod, p.response)
+		}
+	}
+	if err != nil {
+		return Event{}, consumed, err
+	}
+
+	p.bodyRemaining = p.bodyLength
+	switch p.bodyLength {
+	case 0:
+		p.state = messageStateComplete
+	case BodyChunked:
+		p.chunked = NewChunkedDecoder()
+		p.state = messageStateBody
+	default:
+		p.state = messageStateBody
+	}
+
+	return Event{Type: EventHeadersComplete, Start: 0, End: consumed}, consumed, nil
+}
+
+func (p *MessageParser) feedBody(data []byte) (Event, int, error) {
+	switch {
+	case p.chunked != nil:
+		n, start, end, err := p.chunked.Next(data)
+		if err != nil {
+			return Event{}, n, err
+		}
+		if p.chunked.Done() {
+			p.state = messageStateComplete
+		}
+		if start < end {
+			return Event{Type: EventBodyChunk, Start: start, End: end}, n, nil
+		}
+		if p.state == messageStateComplete {
+			return Event{Type: EventMessageComplete}, n, nil
+		}
+		return Event{Type: EventNeedMore}, n, nil
+	case p.bodyLength == BodyUntilClose:
+		if len(data) == 0 {
+			return Event{Type: EventNeedMore}, 0, nil
+		}
+		return Event{Type: EventBodyChunk, Start: 0, End: len(data)}, len(data), nil
+	default:
+		n := int64(len(data))
+		if n > p.bodyRemaining {
+			n = p.bodyRemaining
+		}
+		if n == 0 {
+			return Event{Type: EventNeedMore}, 0, nil
+		}
+		p.bodyRemaining -= n
+		if p.bodyRemaining == 0 {
+			p.state = messageStateComplete
+		}
+		return Event{Type: EventBodyChunk, Start: 0, End: int(n)}, int(n), nil
+	}
+}
+
+// Request returns the parsed request once its headers are complete.
+func (p *MessageParser) Request() entity.HTTPRequest {
+	return p.request
+}
+
+// Response returns the parsed response once its headers are complete.
+func (p *MessageParser) Response() entity.HTTPResponse {
+	return p.response
+}
+
+// Header returns the raw header block once it is complete.
+func (p *MessageParser) Header() []byte {
+	return p.header
+}
+
+// BodyLength returns the body length declared by the header block, or
+// BodyChunked or BodyUntilClose.
+func (p *MessageParser) BodyLength() int64 {
+	return p.bodyLength
+}
+
+// HeadersDone reports whether the header block has been parsed.
+func (p *MessageParser) HeadersDone() bool {
+	return p.state != messageStateHeader
+}
+
+// Complete reports whether the whole message has been consumed.
+func (p *MessageParser) Complete() bool {
+	return p.state == messageStateComplete
+}
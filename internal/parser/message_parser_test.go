@@ -0,0 +1,296 @@
+//go:build linux
+
+package parser
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testMaxHeaderSize = 1024
+
+// parseResult is what a message parsed from a series of reads amounts to.
+type parseResult struct {
+	headers  bool
+	body     string
+	consumed int
+	complete bool
+}
+
+// feedMessage feeds pieces to p the way a worker does, one read at a time,
+// until the message is complete or the pieces run out.
+func feedMessage(t *testing.T, p *MessageParser, pieces [][]byte) (parseResult, error) {
+	t.Helper()
+
+	var result parseResult
+	for _, piece := range pieces {
+		for {
+			event, n, err := p.Feed(piece)
+			result.consumed += n
+			if err != nil {
+				return result, err
+			}
+			switch event.Type {
+			case EventHeadersComplete:
+				result.headers = true
+			case EventBodyChunk:
+				result.body += string(piece[event.Start:event.End])
+			case EventMessageComplete:
+				result.complete = true
+				return result, nil
+			}
+			piece = piece[n:]
+			if event.Type == EventNeedMore {
+				if len(piece) != 0 {
+					t.Fatalf("EventNeedMore left %d bytes unconsumed", len(piece))
+				}
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func TestMessageParserRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		path  string
+		body  string
+	}{
+		{
+			name:  "no body",
+			input: "GET /a?b=c HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			path:  "/a?b=c",
+		},
+		{
+			name:  "content length",
+			input: "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: 11\r\n\r\nhello world",
+			path:  "/upload",
+			body:  "hello world",
+		},
+		{
+			name:  "repeated content length",
+			input: "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+			path:  "/",
+			body:  "hello",
+		},
+		{
+			name:  "chunked",
+			input: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n",
+			path:  "/",
+			body:  "hello world",
+		},
+		{
+			name:  "chunked with extensions and trailers",
+			input: "POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n5;a=b\r\nhello\r\n0\r\nX-Sum: 1\r\n\r\n",
+			path:  "/",
+			body:  "hello",
+		},
+	}
+	for _, tt := range tests {
+		// A pipelined request follows, which must be left for the next
+		// message.
+		input := []byte(tt.input + "GET /next HTTP/1.1\r\n\r\n")
+		for _, pieces := range splits(input) {
+			p := NewRequestParser(testMaxHeaderSize)
+			result, err := feedMessage(t, p, pieces)
+			if err != nil {
+				t.Fatalf("%s: split %d: unexpected error: %v", tt.name, len(pieces[0]), err)
+			}
+			if !result.headers || !result.complete {
+				t.Fatalf("%s: split %d: headers=%v complete=%v", tt.name, len(pieces[0]), result.headers, result.complete)
+			}
+			if result.body != tt.body {
+				t.Fatalf("%s: split %d: body %q, want %q", tt.name, len(pieces[0]), result.body, tt.body)
+			}
+			if result.consumed != len(tt.input) {
+				t.Fatalf("%s: split %d: consumed %d bytes, want %d", tt.name, len(pieces[0]), result.consumed, len(tt.input))
+			}
+			if req := p.Request(); req.Path != tt.path {
+				t.Fatalf("%s: split %d: path %q, want %q", tt.name, len(pieces[0]), req.Path, tt.path)
+			}
+		}
+	}
+}
+
+func TestMessageParserRejectsRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"content length and chunked", "POST / HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"},
+		{"chunked and content length", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n"},
+		{"content length and identity", "POST / HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: identity\r\n\r\nhello"},
+		{"unsupported transfer encoding", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\nhello"},
+		{"conflicting content lengths", "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!"},
+		{"signed content length", "POST / HTTP/1.1\r\nContent-Length: +5\r\n\r\nhello"},
+		{"negative content length", "POST / HTTP/1.1\r\nContent-Length: -5\r\n\r\nhello"},
+		{"hex content length", "POST / HTTP/1.1\r\nContent-Length: 0x5\r\n\r\nhello"},
+		{"listed content length", "POST / HTTP/1.1\r\nContent-Length: 5, 5\r\n\r\nhello"},
+		{"empty content length", "POST / HTTP/1.1\r\nContent-Length:\r\n\r\n"},
+		{"bare LF in chunked body", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\nhello\r\n0\r\n\r\n"},
+		{"malformed request line", "GET /\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		for _, pieces := range splits([]byte(tt.input)) {
+			result, err := feedMessage(t, NewRequestParser(testMaxHeaderSize), pieces)
+			if err == nil {
+				t.Fatalf("%s: split %d: want an error, got complete=%v", tt.name, len(pieces[0]), result.complete)
+			}
+		}
+	}
+}
+
+func TestMessageParserHeaderTooLarge(t *testing.T) {
+	requestLine := "GET / HTTP/1.1\r\n"
+	field := func(size int) string {
+		return "X-Pad: " + strings.Repeat("a", size-len("X-Pad: \r\n\r\n")) + "\r\n\r\n"
+	}
+	atLimit := requestLine + field(testMaxHeaderSize-len(requestLine))
+	overLimit := requestLine + field(testMaxHeaderSize-len(requestLine)+1)
+
+	for _, pieces := range splits([]byte(atLimit)) {
+		result, err := feedMessage(t, NewRequestParser(testMaxHeaderSize), pieces)
+		if err != nil || !result.complete {
+			t.Fatalf("header of exactly %d bytes, split %d: complete=%v err=%v", len(atLimit), len(pieces[0]), result.complete, err)
+		}
+	}
+	for _, pieces := range splits([]byte(overLimit)) {
+		_, err := feedMessage(t, NewRequestParser(testMaxHeaderSize), pieces)
+		if !errors.Is(err, ErrHeaderTooLarge) {
+			t.Fatalf("header of %d bytes, split %d: got %v, want ErrHeaderTooLarge", len(overLimit), len(pieces[0]), err)
+		}
+	}
+
+	// A header block that never ends is cut off once it passes the limit,
+	// without waiting for the terminator.
+	unterminated := []byte(requestLine + "X-Pad: " + strings.Repeat("a", testMaxHeaderSize))
+	_, err := feedMessage(t, NewRequestParser(testMaxHeaderSize), [][]byte{unterminated})
+	if !errors.Is(err, ErrHeaderTooLarge) {
+		t.Fatalf("unterminated header: got %v, want ErrHeaderTooLarge", err)
+	}
+}
+
+func TestMessageParserResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		input     string
+		status    int
+		body      string
+		untilDone bool
+	}{
+		{
+			name:   "content length",
+			method: HTTPMethodGet,
+			input:  "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+			status: 200,
+			body:   "hello",
+		},
+		{
+			name:   "chunked",
+			method: HTTPMethodGet,
+			input:  "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			status: 200,
+			body:   "hello",
+		},
+		{
+			// Chunked framing wins, and Content-Length is ignored.
+			name:   "content length and chunked",
+			method: HTTPMethodGet,
+			input:  "HTTP/1.1 200 OK\r\nContent-Length: 100\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			status: 200,
+			body:   "hello",
+		},
+		{
+			name:   "head",
+			method: HTTPMethodHead,
+			input:  "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n",
+			status: 200,
+		},
+		{
+			name:   "no content",
+			method: HTTPMethodGet,
+			input:  "HTTP/1.1 204 No Content\r\n\r\n",
+			status: 204,
+		},
+		{
+			name:   "not modified",
+			method: HTTPMethodGet,
+			input:  "HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n",
+			status: 304,
+		},
+		{
+			name:      "until close",
+			method:    HTTPMethodGet,
+			input:     "HTTP/1.1 200 OK\r\n\r\nhello",
+			status:    200,
+			body:      "hello",
+			untilDone: true,
+		},
+	}
+	for _, tt := range tests {
+		for _, pieces := range splits([]byte(tt.input)) {
+			p := NewResponseParser(tt.method, testMaxHeaderSize)
+			result, err := feedMessage(t, p, pieces)
+			if err != nil {
+				t.Fatalf("%s: split %d: unexpected error: %v", tt.name, len(pieces[0]), err)
+			}
+			if tt.untilDone {
+				if result.complete {
+					t.Fatalf("%s: split %d: complete before the connection closed", tt.name, len(pieces[0]))
+				}
+				if err := p.Finish(); err != nil || !p.Complete() {
+					t.Fatalf("%s: split %d: Finish: complete=%v err=%v", tt.name, len(pieces[0]), p.Complete(), err)
+				}
+			} else if !result.complete {
+				t.Fatalf("%s: split %d: not complete", tt.name, len(pieces[0]))
+			}
+			if result.body != tt.body {
+				t.Fatalf("%s: split %d: body %q, want %q", tt.name, len(pieces[0]), result.body, tt.body)
+			}
+			if status := p.Response().StatusCode; status != tt.status {
+				t.Fatalf("%s: split %d: status %d, want %d", tt.name, len(pieces[0]), status, tt.status)
+			}
+		}
+	}
+}
+
+func TestMessageParserFinishTruncated(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"nothing", ""},
+		{"partial header", "HTTP/1.1 200 OK\r\nContent-Le"},
+		{"short body", "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhel"},
+		{"unfinished chunked body", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n"},
+	}
+	for _, tt := range tests {
+		p := NewResponseParser(HTTPMethodGet, testMaxHeaderSize)
+		if _, err := feedMessage(t, p, [][]byte{[]byte(tt.input)}); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if err := p.Finish(); err == nil {
+			t.Fatalf("%s: Finish: want an error", tt.name)
+		}
+	}
+}
+
+func TestMessageParserReset(t *testing.T) {
+	input := []byte("POST /a HTTP/1.1\r\nContent-Length: 1\r\n\r\nxGET /b HTTP/1.1\r\n\r\n")
+
+	p := NewRequestParser(testMaxHeaderSize)
+	first, err := feedMessage(t, p, [][]byte{input})
+	if err != nil || !first.complete || p.Request().Path != "/a" {
+		t.Fatalf("first request: %+v, path %q, err %v", first, p.Request().Path, err)
+	}
+
+	p.Reset()
+	second, err := feedMessage(t, p, [][]byte{input[first.consumed:]})
+	if err != nil || !second.complete || p.Request().Path != "/b" || second.body != "" {
+		t.Fatalf("second request: %+v, path %q, err %v", second, p.Request().Path, err)
+	}
+}
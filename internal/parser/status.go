@@ -0,0 +1,168 @@
+//go:build linux
+
+package parser
+
+import "fmt"
+
+// Status codes registered with IANA, see
+// https://www.iana.org/assignments/http-status-codes.
+const (
+	HTTPStatusCodeContinue           = 100
+	HTTPStatusCodeSwitchingProtocols = 101
+	HTTPStatusCodeProcessing         = 102
+	HTTPStatusCodeEarlyHints         = 103
+
+	HTTPStatusCodeOK                   = 200
+	HTTPStatusCodeCreated              = 201
+	HTTPStatusCodeAccepted             = 202
+	HTTPStatusCodeNonAuthoritativeInfo = 203
+	HTTPStatusCodeNoContent            = 204
+	HTTPStatusCodeResetContent         = 205
+	HTTPStatusCodePartialContent       = 206
+	HTTPStatusCodeMultiStatus          = 207
+	HTTPStatusCodeAlreadyReported      = 208
+	HTTPStatusCodeIMUsed               = 226
+
+	HTTPStatusCodeMultipleChoices   = 300
+	HTTPStatusCodeMovedPermanently  = 301
+	HTTPStatusCodeFound             = 302
+	HTTPStatusCodeSeeOther          = 303
+	HTTPStatusCodeNotModified       = 304
+	HTTPStatusCodeUseProxy          = 305
+	HTTPStatusCodeTemporaryRedirect = 307
+	HTTPStatusCodePermanentRedirect = 308
+
+	HTTPStatusCodeBadRequest                  = 400
+	HTTPStatusCodeUnauthorized                = 401
+	HTTPStatusCodePaymentRequired             = 402
+	HTTPStatusCodeForbidden                   = 403
+	HTTPStatusCodeNotFound                    = 404
+	HTTPStatusCodeMethodNotAllowed            = 405
+	HTTPStatusCodeNotAcceptable               = 406
+	HTTPStatusCodeProxyAuthRequired           = 407
+	HTTPStatusCodeRequestTimeout              = 408
+	HTTPStatusCodeConflict                    = 409
+	HTTPStatusCodeGone                        = 410
+	HTTPStatusCodeLengthRequired              = 411
+	HTTPStatusCodePreconditionFailed          = 412
+	HTTPStatusCodeContentTooLarge             = 413
+	HTTPStatusCodeURITooLong                  = 414
+	HTTPStatusCodeUnsupportedMediaType        = 415
+	HTTPStatusCodeRangeNotSatisfiable         = 416
+	HTTPStatusCodeExpectationFailed           = 417
+	HTTPStatusCodeMisdirectedRequest          = 421
+	HTTPStatusCodeUnprocessableContent        = 422
+	HTTPStatusCodeLocked                      = 423
+	HTTPStatusCodeFailedDependency            = 424
+	HTTPStatusCodeTooEarly                    = 425
+	HTTPStatusCodeUpgradeRequired             = 426
+	HTTPStatusCodePreconditionRequired        = 428
+	HTTPStatusCodeTooManyRequests             = 429
+	HTTPStatusCodeRequestHeaderFieldsTooLarge = 431
+	HTTPStatusCodeUnavailableForLegalReasons  = 451
+
+	HTTPStatusCodeInternalServerError           = 500
+	HTTPStatusCodeNotImplemented                = 501
+	HTTPStatusCodeBadGateway                    = 502
+	HTTPStatusCodeServiceUnavailable            = 503
+	HTTPStatusCodeGatewayTimeout                = 504
+	HTTPStatusCodeHTTPVersionNotSupported       = 505
+	HTTPStatusCodeVariantAlsoNegotiates         = 506
+	HTTPStatusCodeInsufficientStorage           = 507
+	HTTPStatusCodeLoopDetected                  = 508
+	HTTPStatusCodeNotExtended                   = 510
+	HTTPStatusCodeNetworkAuthenticationRequired = 511
+)
+
+const (
+	HTTPStatusTextOK                  = "OK"
+	HTTPStatusTextNotFound            = "Not Found"
+	HTTPStatusTextMethodNotAllowed    = "Method Not Allowed"
+	HTTPStatusTextInternalServerError = "Internal Server Error"
+	HTTPStatusTextBadGateway          = "Bad Gateway"
+)
+
+var statusText = map[int]string{
+	HTTPStatusCodeContinue:           "Continue",
+	HTTPStatusCodeSwitchingProtocols: "Switching Protocols",
+	HTTPStatusCodeProcessing:         "Processing",
+	HTTPStatusCodeEarlyHints:         "Early Hints",
+
+	HTTPStatusCodeOK:                   HTTPStatusTextOK,
+	HTTPStatusCodeCreated:              "Created",
+	HTTPStatusCodeAccepted:             "Accepted",
+	HTTPStatusCodeNonAuthoritativeInfo: "Non-Authoritative Information",
+	HTTPStatusCodeNoContent:            "No Content",
+	HTTPStatusCodeResetContent:         "Reset Content",
+	HTTPStatusCodePartialContent:       "Partial Content",
+	HTTPStatusCodeMultiStatus:          "Multi-Status",
+	HTTPStatusCodeAlreadyReported:      "Already Reported",
+	HTTPStatusCodeIMUsed:               "IM Used",
+
+	HTTPStatusCodeMultipleChoices:   "Multiple Choices",
+	HTTPStatusCodeMovedPermanently:  "Moved Permanently",
+	HTTPStatusCodeFound:             "Found",
+	HTTPStatusCodeSeeOther:          "See Other",
+	HTTPStatusCodeNotModified:       "Not Modified",
+	HTTPStatusCodeUseProxy:          "Use Proxy",
+	HTTPStatusCodeTemporaryRedirect: "Temporary Redirect",
+	HTTPStatusCodePermanentRedirect: "Permanent Redirect",
+
+	HTTPStatusCodeBadRequest:                  "Bad Request",
+	HTTPStatusCodeUnauthorized:                "Unauthorized",
+	HTTPStatusCodePaymentRequired:             "Payment Required",
+	HTTPStatusCodeForbidden:                   "Forbidden",
+	HTTPStatusCodeNotFound:                    HTTPStatusTextNotFound,
+	HTTPStatusCodeMethodNotAllowed:            HTTPStatusTextMethodNotAllowed,
+	HTTPStatusCodeNotAcceptable:               "Not Acceptable",
+	HTTPStatusCodeProxyAuthRequired:           "Proxy Authentication Required",
+	HTTPStatusCodeRequestTimeout:              "Request Timeout",
+	HTTPStatusCodeConflict:                    "Conflict",
+	HTTPStatusCodeGone:                        "Gone",
+	HTTPStatusCodeLengthRequired:              "Length Required",
+	HTTPStatusCodePreconditionFailed:          "Precondition Failed",
+	HTTPStatusCodeContentTooLarge:             "Content Too Large",
+	HTTPStatusCodeURITooLong:                  "URI Too Long",
+	HTTPStatusCodeUnsupportedMediaType:        "Unsupported Media Type",
+	HTTPStatusCodeRangeNotSatisfiable:         "Range Not Satisfiable",
+	HTTPStatusCodeExpectationFailed:           "Expectation Failed",
+	HTTPStatusCodeMisdirectedRequest:          "Misdirected Request",
+	HTTPStatusCodeUnprocessableContent:        "Unprocessable Content",
+	HTTPStatusCodeLocked:                      "Locked",
+	HTTPStatusCodeFailedDependency:            "Failed Dependency",
+	HTTPStatusCodeTooEarly:                    "Too Early",
+	HTTPStatusCodeUpgradeRequired:             "Upgrade Required",
+	HTTPStatusCodePreconditionRequired:        "Precondition Required",
+	HTTPStatusCodeTooManyRequests:             "Too Many Requests",
+	HTTPStatusCodeRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	HTTPStatusCodeUnavailableForLegalReasons:  "Unavailable For Legal Reasons",
+
+	HTTPStatusCodeInternalServerError:           HTTPStatusTextInternalServerError,
+	HTTPStatusCodeNotImplemented:                "Not Implemented",
+	HTTPStatusCodeBadGateway:                    HTTPStatusTextBadGateway,
+	HTTPStatusCodeServiceUnavailable:            "Service Unavailable",
+	HTTPStatusCodeGatewayTimeout:                "Gateway Timeout",
+	HTTPStatusCodeHTTPVersionNotSupported:       "HTTP Version Not Supported",
+	HTTPStatusCodeVariantAlsoNegotiates:         "Variant Also Negotiates",
+	HTTPStatusCodeInsufficientStorage:           "Insufficient Storage",
+	HTTPStatusCodeLoopDetected:                  "Loop Detected",
+	HTTPStatusCodeNotExtended:                   "Not Extended",
+	HTTPStatusCodeNetworkAuthenticationRequired: "Network Authentication Required",
+}
+
+// HTTPStatusCode returns the reason phrase registered for statusCode.
+func HTTPStatusCode(statusCode int) string {
+	if text, ok := statusText[statusCode]; ok {
+		return text
+	}
+	return fmt.Sprintf("Unknown status code: %d", statusCode)
+}
+
+// StatusCodes returns every status code in the registry.
+func StatusCodes() []int {
+	codes := make([]int, 0, len(statusText))
+	for code := range statusText {
+		codes = append(codes, code)
+	}
+	return codes
+}
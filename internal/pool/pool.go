@@ -0,0 +1,123 @@
+//go:build linux
+
+package pool
+
+import (
+	"time"
+
+	"github.com/stanleydv12/ginx/internal/entity"
+	"github.com/stanleydv12/ginx/internal/socket"
+	"github.com/stanleydv12/ginx/pkg/logger"
+)
+
+// ConnectionPool keeps idle keep-alive upstream connections around so they
+// can be reused by later requests to the same upstream server.
+type ConnectionPool interface {
+	// Get checks out an idle connection to server, if a healthy one exists.
+	Get(server entity.UpstreamServer) (fd int, ok bool)
+	// Put returns a connection to the pool once its response has been fully
+	// read. The pool takes ownership of fd and may close it.
+	Put(server entity.UpstreamServer, fd int)
+	// EvictExpired closes connections that have been idle too long.
+	EvictExpired()
+	// Close closes every idle connection.
+	Close()
+}
+
+type idleConn struct {
+	fd        int
+	idleSince time.Time
+}
+
+type UpstreamPool struct {
+	socket      socket.SocketManager
+	maxIdle     int
+	idleTimeout time.Duration
+	// idle holds the idle connections per upstream server, oldest first.
+	idle map[entity.UpstreamServer][]idleConn
+}
+
+// NewUpstreamPool creates a pool that keeps at most maxIdle idle connections
+// per upstream server, each for at most idleTimeout. A maxIdle below zero
+// disables pooling.
+func NewUpstreamPool(socket socket.SocketManager, maxIdle int, idleTimeout time.Duration) ConnectionPool {
+	return &UpstreamPool{
+		socket:      socket,
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+		idle:        make(map[entity.UpstreamServer][]idleConn),
+	}
+}
+
+func (p *UpstreamPool) Get(server entity.UpstreamServer) (int, bool) {
+	conns := p.idle[server]
+
+	// Most recently used first: it is the least likely to have been closed
+	// by the upstream's own idle timeout.
+	for len(conns) > 0 {
+		c := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+
+		if time.Since(c.idleSince) >= p.idleTimeout || !p.socket.IsSocketAlive(c.fd) {
+			logger.Debug("Discarding stale pooled upstream connection", "upstream_host", server.URL.Host, "fd", c.fd)
+			p.socket.CloseSocket(c.fd)
+			continue
+		}
+
+		p.idle[server] = conns
+		logger.Debug("Reusing pooled upstream connection", "upstream_host", server.URL.Host, "fd", c.fd)
+		return c.fd, true
+	}
+
+	delete(p.idle, server)
+	return -1, false
+}
+
+func (p *UpstreamPool) Put(server entity.UpstreamServer, fd int) {
+	if p.maxIdle < 0 {
+		p.socket.CloseSocket(fd)
+		return
+	}
+
+	conns := append(p.idle[server], idleConn{fd: fd, idleSince: time.Now()})
+
+	// Evict the least recently used connections beyond the limit.
+	for len(conns) > p.maxIdle {
+		p.socket.CloseSocket(conns[0].fd)
+		conns = conns[1:]
+	}
+
+	if len(conns) == 0 {
+		delete(p.idle, server)
+		return
+	}
+	p.idle[server] = conns
+}
+
+func (p *UpstreamPool) EvictExpired() {
+	now := time.Now()
+	for key, conns := range p.idle {
+		// Connections are ordered oldest first, so stop at the first one
+		// that is still fresh.
+		expired := 0
+		for expired < len(conns) && now.Sub(conns[expired].idleSince) >= p.idleTimeout {
+			p.socket.CloseSocket(conns[expired].fd)
+			expired++
+		}
+
+		if expired == len(conns) {
+			delete(p.idle, key)
+		} else if expired > 0 {
+			p.idle[key] = conns[expired:]
+		}
+	}
+}
+
+func (p *UpstreamPool) Close() {
+	for key, conns := range p.idle {
+		for _, c := range conns {
+			p.socket.CloseSocket(c.fd)
+		}
+		delete(p.idle, key)
+	}
+}
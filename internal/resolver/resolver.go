@@ -0,0 +1,285 @@
+//go:build linux
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stanleydv12/ginx/internal/config"
+	"github.com/stanleydv12/ginx/internal/entity"
+	"github.com/stanleydv12/ginx/internal/healthcheck"
+	"github.com/stanleydv12/ginx/internal/loadbalancer"
+	"github.com/stanleydv12/ginx/internal/socket"
+	"github.com/stanleydv12/ginx/pkg/logger"
+)
+
+// ResolverHandler turns the configured upstreams into servers, one per
+// address their host name resolves to, and keeps them in step with DNS.
+type ResolverHandler interface {
+	// Servers returns the upstream servers as last resolved.
+	Servers() []entity.UpstreamServer
+	// Start re-resolves the host names every interval, adding the servers
+	// of new addresses to loadBalancer and health and removing those of
+	// addresses that are gone. It returns immediately.
+	Start(loadBalancer loadbalancer.LoadBalancerHandler, health healthcheck.HealthCheckHandler)
+	// Stop ends re-resolution and waits for a refresh in progress.
+	Stop()
+}
+
+// upstream is one configured upstream and the servers it currently resolves
+// to.
+type upstream struct {
+	config config.UpstreamConfig
+	// url is the upstream's URL with the host name still unresolved.
+	url *url.URL
+	// socketPath is set for an upstream on a Unix domain socket.
+	socketPath string
+	// static is set when the host is an IP address or a Unix socket, which
+	// are never re-resolved.
+	static bool
+	// servers is keyed by resolved address.
+	servers map[string]entity.UpstreamServer
+}
+
+// Resolver looks up every host name at startup and again once per interval.
+// Go's resolver does not report record TTLs, so the interval stands in for
+// them. A failed lookup keeps the servers of the last successful one, so a
+// DNS outage does not empty the load balancer.
+type Resolver struct {
+	config    config.ResolverConfig
+	upstreams []*upstream
+
+	mu sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewResolver parses upstreams and resolves their host names. It fails if a
+// host name cannot be resolved, since there would be nowhere to send its
+// requests.
+func NewResolver(cfg config.ResolverConfig, upstreams []config.UpstreamConfig) (ResolverHandler, error) {
+	r := &Resolver{
+		config: cfg,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	for _, upstreamConfig := range upstreams {
+		u, err := parseUpstream(upstreamConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		addresses := []string{u.url.Hostname()}
+		if u.socketPath != "" {
+			addresses = []string{u.url.Host}
+		} else if !u.static {
+			logger.Info("Resolving hostname", "host", u.url.Hostname())
+			addresses, err = r.lookup(u.url.Hostname())
+			if err != nil {
+				logger.Error("Failed to resolve hostname", "host", u.url.Hostname(), "error", err)
+				return nil, fmt.Errorf("failed to resolve %s: %v", u.url.Hostname(), err)
+			}
+			logger.Debug("Resolved hostname", "host", u.url.Hostname(), "addresses", addresses)
+		}
+
+		for _, address := range addresses {
+			server := u.newServer(address)
+			u.servers[address] = server
+			logger.Info("Added upstream server", "url", server.URL.String())
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	return r, nil
+}
+
+func parseUpstream(cfg config.UpstreamConfig) (*upstream, error) {
+	if path, ok := socket.UnixPath(cfg.URL); ok {
+		if path == "" {
+			return nil, fmt.Errorf("missing path in URL: %s", cfg.URL)
+		}
+		return &upstream{
+			config:     cfg,
+			url:        &url.URL{Scheme: "http", Host: cfg.URL},
+			socketPath: path,
+			static:     true,
+			servers:    make(map[string]entity.UpstreamServer),
+		}, nil
+	}
+
+	server := cfg.URL
+
+	// Ensure the URL has a scheme
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+
+	parsed, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate host
+	if parsed.Host == "" {
+		return nil, fmt.Errorf("missing host in URL: %s", server)
+	}
+
+	return &upstream{
+		config:  cfg,
+		url:     parsed,
+		static:  net.ParseIP(parsed.Hostname()) != nil,
+		servers: make(map[string]entity.UpstreamServer),
+	}, nil
+}
+
+// newServer returns the server for one resolved address of u, keeping the
+// configured port. IPv6 addresses are bracketed, as URLs require. Servers on a
+// Unix socket keep the URL they were configured with.
+func (u *upstream) newServer(address string) entity.UpstreamServer {
+	serverURL := *u.url
+	switch {
+	case u.socketPath != "":
+		// The URL already names the socket.
+	case u.url.Port() != "":
+		serverURL.Host = net.JoinHostPort(address, u.url.Port())
+	case strings.Contains(address, ":"):
+		serverURL.Host = "[" + address + "]"
+	default:
+		serverURL.Host = address
+	}
+
+	return entity.UpstreamServer{
+		URL:         &serverURL,
+		Weight:      u.config.Weight,
+		MaxFails:    u.config.MaxFails,
+		FailTimeout: u.config.FailTimeout,
+		Backup:      u.config.Backup,
+		SocketPath:  u.socketPath,
+	}
+}
+
+func (r *Resolver) Servers() []entity.UpstreamServer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	servers := []entity.UpstreamServer{}
+	for _, u := range r.upstreams {
+		// Sorted, so hash balancers see the same order on every start.
+		addresses := make([]string, 0, len(u.servers))
+		for address := range u.servers {
+			addresses = append(addresses, address)
+		}
+		slices.Sort(addresses)
+
+		for _, address := range addresses {
+			servers = append(servers, u.servers[address])
+		}
+	}
+	return servers
+}
+
+func (r *Resolver) Start(loadBalancer loadbalancer.LoadBalancerHandler, health healthcheck.HealthCheckHandler) {
+	dynamic := slices.ContainsFunc(r.upstreams, func(u *upstream) bool {
+		return !u.static
+	})
+	if !dynamic || r.config.Interval < 0 {
+		close(r.done)
+		return
+	}
+
+	logger.Info("Starting upstream DNS re-resolution", "interval", r.config.Interval.String())
+	go r.run(loadBalancer, health)
+}
+
+func (r *Resolver) Stop() {
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	<-r.done
+}
+
+func (r *Resolver) run(loadBalancer loadbalancer.LoadBalancerHandler, health healthcheck.HealthCheckHandler) {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, u := range r.upstreams {
+			if !u.static {
+				r.refresh(u, loadBalancer, health)
+			}
+		}
+	}
+}
+
+// refresh resolves the host name of u again and brings the servers of
+// loadBalancer and health in line with the answer.
+func (r *Resolver) refresh(u *upstream, loadBalancer loadbalancer.LoadBalancerHandler, health healthcheck.HealthCheckHandler) {
+	addresses, err := r.lookup(u.url.Hostname())
+	if err != nil {
+		logger.Error("Failed to re-resolve hostname, keeping the previous addresses", "host", u.url.Hostname(), "error", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, address := range addresses {
+		if _, exists := u.servers[address]; exists {
+			continue
+		}
+		server := u.newServer(address)
+		if err := loadBalancer.AddServer(server); err != nil {
+			logger.Error("Failed to add upstream server", "url", server.URL.String(), "error", err)
+			continue
+		}
+		health.AddServer(server)
+		u.servers[address] = server
+		logger.Info("Added upstream server", "host", u.url.Hostname(), "url", server.URL.String())
+	}
+
+	for address, server := range u.servers {
+		if slices.Contains(addresses, address) {
+			continue
+		}
+		if err := loadBalancer.RemoveServer(server); err != nil {
+			logger.Error("Failed to remove upstream server", "url", server.URL.String(), "error", err)
+			continue
+		}
+		health.RemoveServer(server)
+		delete(u.servers, address)
+		logger.Info("Removed upstream server", "host", u.url.Hostname(), "url", server.URL.String())
+	}
+}
+
+// lookup returns the addresses host resolves to.
+func (r *Resolver) lookup(host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.Timeout)
+	defer cancel()
+
+	addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no IP addresses found for %s", host)
+	}
+	return addresses, nil
+}
@@ -0,0 +1,249 @@
+//go:build linux
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/stanleydv12/ginx/internal/config"
+)
+
+// Location modifiers, as written before the path of a location.
+const (
+	modifierExact        = "="
+	modifierPrefix       = ""
+	modifierNoRegexp     = "^~"
+	modifierRegexp       = "~"
+	modifierRegexpNoCase = "~*"
+)
+
+// RouterHandler picks the location of a virtual host that serves a request.
+type RouterHandler interface {
+	// Route finds the location matching path, which may carry a query
+	// string, and returns it with the path to forward. It returns false if
+	// no location matches, and an error if path is malformed.
+	Route(path string) (Route, bool, error)
+}
+
+// Route is a request path matched to a location.
+type Route struct {
+	Location config.LocationConfig
+	// Path is the path to forward: the original path if the location does
+	// not rewrite it, and otherwise the rewritten path, escaped again, with
+	// the query string of the original path appended.
+	Path string
+}
+
+// location is a compiled location block.
+type location struct {
+	config   config.LocationConfig
+	modifier string
+	// pattern is the path without its modifier.
+	pattern string
+	regexp  *regexp.Regexp
+}
+
+// Router matches paths the way nginx matches locations. Paths are decoded and
+// normalized first, so that "/%61dmin" or "/public/../admin" cannot slip past
+// the location of "/admin". An exact location then wins outright; otherwise
+// the longest matching prefix is remembered, and unless it is marked "^~" the
+// regexp locations are tried in the order they were configured, the first
+// match winning. The longest prefix is used if no regexp matches.
+type Router struct {
+	exact map[string]*location
+	// prefixes is sorted longest first.
+	prefixes []*location
+	regexps  []*location
+}
+
+func NewRouter(locations []config.LocationConfig) (RouterHandler, error) {
+	r := &Router{exact: make(map[string]*location)}
+	seen := make(map[string]bool)
+
+	for _, cfg := range locations {
+		loc, err := compileLocation(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("location %q: %w", cfg.Path, err)
+		}
+
+		// "/api" and "^~ /api" are the same prefix, so they clash too.
+		key := loc.modifier + " " + loc.pattern
+		if loc.modifier == modifierNoRegexp {
+			key = modifierPrefix + " " + loc.pattern
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate location %q", cfg.Path)
+		}
+		seen[key] = true
+
+		switch loc.modifier {
+		case modifierExact:
+			r.exact[loc.pattern] = loc
+		case modifierPrefix, modifierNoRegexp:
+			r.prefixes = append(r.prefixes, loc)
+		default:
+			r.regexps = append(r.regexps, loc)
+		}
+	}
+
+	sort.SliceStable(r.prefixes, func(i, j int) bool {
+		return len(r.prefixes[i].pattern) > len(r.prefixes[j].pattern)
+	})
+	return r, nil
+}
+
+// compileLocation parses the path of a location and checks that its rewrite
+// fits it.
+func compileLocation(cfg config.LocationConfig) (*location, error) {
+	loc := &location{config: cfg, modifier: modifierPrefix, pattern: cfg.Path}
+	if modifier, pattern, found := strings.Cut(cfg.Path, " "); found {
+		switch modifier {
+		case modifierExact, modifierNoRegexp, modifierRegexp, modifierRegexpNoCase:
+			loc.modifier, loc.pattern = modifier, strings.TrimSpace(pattern)
+		}
+	}
+
+	switch loc.modifier {
+	case modifierRegexp, modifierRegexpNoCase:
+		pattern := loc.pattern
+		if loc.modifier == modifierRegexpNoCase {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		loc.regexp = re
+		if cfg.StripPrefix {
+			return nil, errors.New("strip_prefix needs a prefix or exact location")
+		}
+	default:
+		if !strings.HasPrefix(loc.pattern, "/") {
+			return nil, errors.New("path must start with /")
+		}
+	}
+
+	if cfg.StripPrefix && cfg.Rewrite != "" {
+		return nil, errors.New("strip_prefix and rewrite cannot both be set")
+	}
+	return loc, nil
+}
+
+func (r *Router) Route(path string) (Route, bool, error) {
+	original := path
+	path, query, hasQuery := strings.Cut(path, "?")
+	if !strings.HasPrefix(path, "/") {
+		// "*", which no location serves.
+		return Route{}, false, nil
+	}
+
+	path, err := normalizePath(path)
+	if err != nil {
+		return Route{}, false, err
+	}
+
+	loc, match := r.match(path)
+	if loc == nil {
+		return Route{}, false, nil
+	}
+	if !loc.config.StripPrefix && loc.config.Rewrite == "" {
+		return Route{Location: loc.config, Path: original}, true, nil
+	}
+
+	// The rewrite works on the decoded path, and may add a query string of
+	// its own.
+	rewritten, rewrittenQuery, hasRewrittenQuery := strings.Cut(loc.rewrite(path, match), "?")
+	rewritten = (&url.URL{Path: rewritten}).EscapedPath()
+	if hasRewrittenQuery {
+		rewritten += "?" + rewrittenQuery
+	}
+	if hasQuery {
+		if hasRewrittenQuery {
+			rewritten += "&" + query
+		} else {
+			rewritten += "?" + query
+		}
+	}
+	return Route{Location: loc.config, Path: rewritten}, true, nil
+}
+
+// normalizePath decodes path, merges repeated slashes and resolves "." and
+// ".." segments, as nginx does before it matches locations. A trailing slash
+// is kept. Paths that climb above the root are rejected.
+func normalizePath(path string) (string, error) {
+	decoded, err := url.PathUnescape(path)
+	if err != nil {
+		return "", fmt.Errorf("malformed path %q: %w", path, err)
+	}
+
+	var segments []string
+	rawSegments := strings.Split(decoded[1:], "/")
+	for _, segment := range rawSegments {
+		switch segment {
+		case "", ".":
+		case "..":
+			if len(segments) == 0 {
+				return "", fmt.Errorf("path %q climbs above the root", path)
+			}
+			segments = segments[:len(segments)-1]
+		default:
+			segments = append(segments, segment)
+		}
+	}
+
+	normalized := "/" + strings.Join(segments, "/")
+	switch rawSegments[len(rawSegments)-1] {
+	case "", ".", "..":
+		if len(segments) > 0 {
+			normalized += "/"
+		}
+	}
+	return normalized, nil
+}
+
+// match returns the location for path and, for a regexp location, the
+// indexes of its submatches.
+func (r *Router) match(path string) (*location, []int) {
+	if loc, exists := r.exact[path]; exists {
+		return loc, nil
+	}
+
+	var longest *location
+	for _, loc := range r.prefixes {
+		if strings.HasPrefix(path, loc.pattern) {
+			longest = loc
+			break
+		}
+	}
+	if longest != nil && longest.modifier == modifierNoRegexp {
+		return longest, nil
+	}
+
+	for _, loc := range r.regexps {
+		if match := loc.regexp.FindStringSubmatchIndex(path); match != nil {
+			return loc, match
+		}
+	}
+	return longest, nil
+}
+
+// rewrite applies the location's strip_prefix or rewrite to path. The result
+// always starts with a slash.
+func (l *location) rewrite(path string, match []int) string {
+	if l.regexp != nil {
+		replacement := l.regexp.ExpandString(nil, l.config.Rewrite, path, match)
+		path = path[:match[0]] + string(replacement) + path[match[1]:]
+	} else {
+		path = l.config.Rewrite + path[len(l.pattern):]
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
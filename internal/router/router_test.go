@@ -0,0 +1,136 @@
+//go:build linux
+
+package router
+
+import (
+	"testing"
+
+	"github.com/stanleydv12/ginx/internal/config"
+)
+
+func newTestRouter(t *testing.T) RouterHandler {
+	t.Helper()
+
+	r, err := NewRouter([]config.LocationConfig{
+		{Path: "= /admin", Upstream: "admin-exact"},
+		{Path: "/admin/", Upstream: "admin"},
+		{Path: "/public/", Upstream: "public"},
+		{Path: "/static/", Upstream: "static", StripPrefix: true},
+		{Path: "~ ^/users/(\\d+)$", Upstream: "users", Rewrite: "/user?id=$1"},
+	})
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	return r
+}
+
+func TestRouteNormalizesPath(t *testing.T) {
+	r := newTestRouter(t)
+
+	tests := []struct {
+		path     string
+		upstream string
+		forward  string
+	}{
+		{"/admin", "admin-exact", "/admin"},
+		{"/%61dmin", "admin-exact", "/%61dmin"},
+		{"/%61dmin/users", "admin", "/%61dmin/users"},
+		{"/public/../admin", "admin-exact", "/public/../admin"},
+		{"/public/../admin/users", "admin", "/public/../admin/users"},
+		{"/public/%2e%2e/admin/", "admin", "/public/%2e%2e/admin/"},
+		{"/public/./../admin?x=1", "admin-exact", "/public/./../admin?x=1"},
+		{"//admin", "admin-exact", "//admin"},
+		{"/public//admin", "public", "/public//admin"},
+		{"/admin/..", "", ""},
+		{"/public/a/..", "public", "/public/a/.."},
+	}
+	for _, tt := range tests {
+		route, matched, err := r.Route(tt.path)
+		if err != nil {
+			t.Errorf("Route(%q): unexpected error: %v", tt.path, err)
+			continue
+		}
+		if tt.upstream == "" {
+			if matched {
+				t.Errorf("Route(%q) matched %q, want no match", tt.path, route.Location.Path)
+			}
+			continue
+		}
+		if !matched {
+			t.Errorf("Route(%q) matched nothing, want %q", tt.path, tt.upstream)
+			continue
+		}
+		if route.Location.Upstream != tt.upstream || route.Path != tt.forward {
+			t.Errorf("Route(%q) = %q, %q; want %q, %q", tt.path, route.Location.Upstream, route.Path, tt.upstream, tt.forward)
+		}
+	}
+}
+
+func TestRouteRewritesNormalizedPath(t *testing.T) {
+	r := newTestRouter(t)
+
+	tests := []struct {
+		path    string
+		forward string
+	}{
+		{"/static/app.js", "/app.js"},
+		{"/static/%61pp.js?v=2", "/app.js?v=2"},
+		{"/static/x/../a%20b.css", "/a%20b.css"},
+		{"/public/../static/app.js", "/app.js"},
+		{"/users/%34%32", "/user?id=42"},
+		{"/users/42?full=1", "/user?id=42&full=1"},
+	}
+	for _, tt := range tests {
+		route, matched, err := r.Route(tt.path)
+		if err != nil || !matched {
+			t.Errorf("Route(%q) = %v, %v; want a match", tt.path, matched, err)
+			continue
+		}
+		if route.Path != tt.forward {
+			t.Errorf("Route(%q) forwards %q, want %q", tt.path, route.Path, tt.forward)
+		}
+	}
+}
+
+func TestRouteRejectsMalformedPath(t *testing.T) {
+	r := newTestRouter(t)
+
+	for _, path := range []string{
+		"/..",
+		"/public/../../admin",
+		"/%2e%2e/admin",
+		"/admin%zz",
+		"/admin%2",
+	} {
+		if _, _, err := r.Route(path); err == nil {
+			t.Errorf("Route(%q): want an error", path)
+		}
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "/"},
+		{"//", "/"},
+		{"/a//b", "/a/b"},
+		{"/a/./b", "/a/b"},
+		{"/a/b/..", "/a/"},
+		{"/a/b/.", "/a/b/"},
+		{"/a/b/", "/a/b/"},
+		{"/a/..", "/"},
+		{"/%41%2fb", "/A/b"},
+	}
+	for _, tt := range tests {
+		got, err := normalizePath(tt.path)
+		if err != nil {
+			t.Errorf("normalizePath(%q): unexpected error: %v", tt.path, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/stanleydv12/ginx/internal/connection"
+	"github.com/stanleydv12/ginx/internal/entity"
+	"github.com/stanleydv12/ginx/internal/parser"
+	"github.com/stanleydv12/ginx/pkg/logger"
+
+	"golang.org/x/sys/unix"
+)
+
+// statusError is an error that the client should be told about with a
+// response of the given status, rather than by the connection just closing.
+type statusError struct {
+	statusCode int
+	err        error
+}
+
+func (e *statusError) Error() string {
+	return strconv.Itoa(e.statusCode) + " " + parser.HTTPStatusCode(e.statusCode) + ": " + e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// withStatus attaches the status the client should be answered with to err.
+func withStatus(statusCode int, err error) error {
+	return &statusError{statusCode: statusCode, err: err}
+}
+
+// upstreamStatus picks the status for a failure talking to the upstream.
+func upstreamStatus(err error) int {
+	if errors.Is(err, unix.ETIMEDOUT) {
+		return parser.HTTPStatusCodeGatewayTimeout
+	}
+	return parser.HTTPStatusCodeBadGateway
+}
+
+// failRequest ends a request that failed with err, unless it can be retried on
+// another upstream. Errors carrying a status are answered with an error
+// response, unless part of the upstream response has already been sent;
+// anything else just closes the connection.
+func (w *worker) failRequest(conn *connection.Connection, err error) {
+	if w.retryRequest(conn, err) {
+		return
+	}
+
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) {
+		if !errors.Is(err, errClientClosed) {
+			logger.Error("Request failed", "client_fd", conn.ClientFD, "error", err)
+		}
+		w.cleanupConnection(conn.ClientFD)
+		return
+	}
+
+	logger.Error("Request failed", "client_fd", conn.ClientFD, "upstream_fd", conn.UpstreamFD, "status_code", statusErr.statusCode, "error", statusErr.err)
+
+	if conn.State == connection.StateSendingResponse || conn.BytesSent > 0 {
+		w.cleanupConnection(conn.ClientFD)
+		return
+	}
+
+	w.releaseUpstream(conn)
+	w.sendErrorResponse(conn, statusErr.statusCode)
+}
+
+// sendErrorResponse answers the client with a synthesized response in place
+// of anything still queued for it, then closes the connection once the
+// response has been written.
+func (w *worker) sendErrorResponse(conn *connection.Connection, statusCode int) {
+	contentType, body := w.errorPages.Render(statusCode)
+
+	response := entity.HTTPResponse{StatusCode: statusCode}
+	response.Headers.Set("Server", "ginx")
+	response.Headers.Set("Content-Type", contentType)
+	response.Headers.Set("Content-Length", strconv.Itoa(len(body)))
+	response.Headers.Set("Connection", "close")
+	if conn.Request.Method != parser.HTTPMethodHead {
+		response.Body = body
+	}
+
+	conn.Response = response
+	conn.ClientBuffer = w.httpParser.RebuildResponse(response)
+	conn.KeepAlive = false
+	conn.State = connection.StateError
+
+	w.flushErrorResponse(conn)
+}
+
+// flushErrorResponse writes as much of a queued error response as the client
+// accepts and closes the connection once it has all been sent.
+func (w *worker) flushErrorResponse(conn *connection.Connection) {
+	for len(conn.ClientBuffer) > 0 {
+		n, err := w.poller.Write(conn.ClientFD, conn.ClientBuffer)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+				w.setTimeout(conn, connection.TimeoutSend)
+				if err := w.setClientWriteBlocked(conn, true); err != nil {
+					w.cleanupConnection(conn.ClientFD)
+				}
+				return
+			}
+			if err == unix.EINTR {
+				continue
+			}
+			logger.Error("Failed to write error response to client", "error", err)
+			break
+		}
+		conn.ClientBuffer = conn.ClientBuffer[n:]
+		conn.BytesSent += int64(n)
+	}
+
+	logger.Info("Request completed", "client_fd", conn.ClientFD, "status_code", conn.Response.StatusCode, "bytes_sent", conn.BytesSent)
+	w.cleanupConnection(conn.ClientFD)
+}
@@ -0,0 +1,143 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/stanleydv12/ginx/internal/config"
+	"github.com/stanleydv12/ginx/internal/socket"
+	"github.com/stanleydv12/ginx/pkg/logger"
+
+	"golang.org/x/sys/unix"
+)
+
+// listener is an address the server accepts connections on, with the virtual
+// hosts reachable through it.
+type listener struct {
+	config       config.ListenConfig
+	virtualHosts []*VirtualHost
+	// defaultHost serves the requests whose Host matches no server name.
+	defaultHost *VirtualHost
+	// sharedFd is the socket all workers accept from when listening on a
+	// Unix socket, and 0 otherwise.
+	sharedFd int
+}
+
+// newListeners gathers the listen addresses of all virtual hosts. Virtual
+// hosts that list the same address share its listener.
+func newListeners(virtualHosts []*VirtualHost) []*listener {
+	var listeners []*listener
+	for _, vhost := range virtualHosts {
+		for _, listen := range vhost.Config.Listen {
+			i := slices.IndexFunc(listeners, func(l *listener) bool {
+				return l.config.Address == listen.Address && l.config.Port == listen.Port
+			})
+			if i < 0 {
+				i = len(listeners)
+				listeners = append(listeners, &listener{config: listen})
+			}
+
+			l := listeners[i]
+			l.virtualHosts = append(l.virtualHosts, vhost)
+			if l.defaultHost == nil || (vhost.Config.DefaultServer && !l.defaultHost.Config.DefaultServer) {
+				l.defaultHost = vhost
+			}
+		}
+	}
+	return listeners
+}
+
+// bindListener creates a listening socket on an IP address and port, or on
+// the path of a "unix:" address.
+func (s *Server) bindListener(cfg config.ListenConfig, reusePort bool) (int, error) {
+	fd, err := s.socket.CreateSocket(&socket.SocketOptions{
+		NonBlocking: true,
+		ReuseAddr:   true,
+		ReusePort:   reusePort,
+		Type:        unix.SOCK_STREAM,
+		Domain:      socket.Domain(cfg.Address),
+		V6Only:      cfg.IPv6Only,
+	})
+	if err != nil {
+		logger.Error("Failed to create socket", "error", err)
+		return 0, err
+	}
+
+	if err := s.socket.BindSocket(fd, cfg.Address, cfg.Port); err != nil {
+		logger.Error("Failed to bind socket", "address", listenAddress(cfg), "error", err)
+		s.socket.CloseSocket(fd)
+		return 0, err
+	}
+
+	if err := s.socket.StartListening(fd); err != nil {
+		logger.Error("Failed to listen on socket", "address", listenAddress(cfg), "error", err)
+		s.socket.CloseSocket(fd)
+		return 0, err
+	}
+	return fd, nil
+}
+
+// listenUnix binds the Unix socket at path that all workers accept from,
+// first removing a socket file left behind by a previous run.
+func (s *Server) listenUnix(l *listener, path string) error {
+	if err := removeStaleSocket(path); err != nil {
+		logger.Error("Failed to remove stale unix socket", "path", path, "error", err)
+		return err
+	}
+
+	fd, err := s.bindListener(l.config, false)
+	if err != nil {
+		return err
+	}
+	l.sharedFd = fd
+	return nil
+}
+
+// closeUnixListener closes a Unix socket listener and removes its file, so
+// the next start does not find it in the way.
+func (s *Server) closeUnixListener(l *listener, path string) {
+	if err := s.socket.CloseSocket(l.sharedFd); err != nil {
+		logger.Error("Failed to close socket", "error", err)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Error("Failed to remove unix socket", "path", path, "error", err)
+	}
+}
+
+// removeStaleSocket deletes the socket file at path unless a process still
+// accepts connections on it. Anything that is not a socket is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+
+	logger.Info("Removing stale unix socket", "path", path)
+	return os.Remove(path)
+}
+
+// listenAddress formats a listen address for logs.
+func listenAddress(cfg config.ListenConfig) string {
+	if _, ok := socket.UnixPath(cfg.Address); ok {
+		return cfg.Address
+	}
+	return net.JoinHostPort(cfg.Address, strconv.Itoa(cfg.Port))
+}
@@ -0,0 +1,293 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/stanleydv12/ginx/internal/connection"
+	"github.com/stanleydv12/ginx/internal/entity"
+	"github.com/stanleydv12/ginx/internal/loadbalancer"
+	"github.com/stanleydv12/ginx/internal/parser"
+	"github.com/stanleydv12/ginx/internal/socket"
+	"github.com/stanleydv12/ginx/pkg/logger"
+
+	"golang.org/x/sys/unix"
+)
+
+func (w *worker) handleClientRequest(clientFd int) error {
+	logger.Debug("Processing client request", "client_fd", clientFd)
+
+	conn, exists := w.connections[clientFd]
+
+	if !exists {
+		return fmt.Errorf("connection not found for fd %d", clientFd)
+	}
+
+	if conn.RequestParser == nil {
+		conn.RequestParser = parser.NewRequestParser(maxHeaderSize)
+	}
+
+	buf := make([]byte, readBufferSize)
+
+	// Keep reading until the header block is complete or the socket is
+	// drained; with EPOLLET we will not be notified again for buffered data.
+	for !conn.RequestParser.HeadersDone() {
+		if len(conn.ReadBuffer) == 0 {
+			n, err := w.poller.Read(clientFd, buf)
+			if err != nil {
+				if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+					return nil
+				}
+				if err == unix.EINTR {
+					logger.Info("handleClientRequest: EINTR", "fd", clientFd)
+					continue
+				}
+				logger.Error("Failed to read from socket", "error", err)
+				return err
+			}
+			if n == 0 {
+				if len(conn.RequestParser.Header()) == 0 {
+					return errClientClosed
+				}
+				return conn.RequestParser.Finish()
+			}
+			// The first byte of the next request ends the keep-alive wait
+			// and starts the clock on its header.
+			if conn.Timeout == connection.TimeoutKeepAlive {
+				w.setTimeout(conn, connection.TimeoutClientHeader)
+			}
+			conn.ReadBuffer = append(conn.ReadBuffer, buf[:n]...)
+		}
+
+		_, n, err := conn.RequestParser.Feed(conn.ReadBuffer)
+		conn.ReadBuffer = conn.ReadBuffer[n:]
+		if err != nil {
+			logger.Error("Failed to parse HTTP request", "error", err)
+			if errors.Is(err, parser.ErrHeaderTooLarge) {
+				return withStatus(parser.HTTPStatusCodeRequestHeaderFieldsTooLarge, err)
+			}
+			return withStatus(parser.HTTPStatusCodeBadRequest, err)
+		}
+	}
+
+	req := conn.RequestParser.Request()
+	conn.Request = req
+	conn.UpstreamBuffer = nil
+
+	vhost := w.listeners[conn.Listener].virtualHost(req.Headers.Get("Host"))
+	upstream, err := route(vhost, &req)
+	if err != nil {
+		return err
+	}
+	conn.Request = req
+	conn.Upstream = upstream
+
+	if max := w.config.Server.ClientMaxBodySize; max > 0 && conn.RequestParser.BodyLength() > max {
+		return withStatus(parser.HTTPStatusCodeContentTooLarge, fmt.Errorf("request body of %d bytes exceeds client_max_body_size", conn.RequestParser.BodyLength()))
+	}
+
+	// Whatever body bytes arrived together with the header are queued now;
+	// the rewritten header is put in front of them once the upstream is
+	// chosen, and the rest is streamed from the client socket as it arrives.
+	n, err := w.queueRequestBody(conn, conn.ReadBuffer)
+	if err != nil {
+		logger.Error("Failed to parse HTTP request body", "error", err)
+		return err
+	}
+	conn.ReadBuffer = append([]byte{}, conn.ReadBuffer[n:]...)
+
+	conn.Requests++
+	w.retryBudget.request(time.Now())
+	conn.State = connection.StateRequestReceived
+	w.connections[clientFd] = conn
+
+	logger.Info("HTTP request received", "client_fd", clientFd, "method", req.Method, "path", req.Path, "host", req.Headers.Get("Host"), "virtual_host", vhost.Config.Name(), "upstream", upstream, "body_length", conn.RequestParser.BodyLength())
+
+	return nil
+}
+
+func (w *worker) handleConnectUpstream(clientFd int) error {
+	conn, exists := w.connections[clientFd]
+
+	if !exists {
+		return fmt.Errorf("connection not found for fd %d", clientFd)
+	}
+
+	logger.Debug("Initiating upstream connection", "client_fd", clientFd)
+
+	loadBalancer, exists := w.upstreams.Get(conn.Upstream)
+	if !exists {
+		return withStatus(parser.HTTPStatusCodeServiceUnavailable, fmt.Errorf("unknown upstream %s", conn.Upstream))
+	}
+
+	upstreamServer, err := loadBalancer.SelectServer(loadbalancer.RequestContext{
+		ClientIP: w.requestClientIP(conn),
+		Request:  conn.Request,
+		Tried:    conn.TriedServers,
+	})
+	if err != nil {
+		logger.Error("Failed to select upstream server", "error", err)
+		return withStatus(parser.HTTPStatusCodeServiceUnavailable, err)
+	}
+
+	logger.Debug("Selected upstream server for request", "client_fd", clientFd, "upstream_host", upstreamServer.URL.Host)
+
+	conn.UpstreamServer = upstreamServer
+	header := w.rewriteRequest(conn)
+	conn.RequestHeaderSize = len(header)
+	conn.UpstreamBuffer = append(header, conn.UpstreamBuffer...)
+
+	upstreamFd, pooled := w.pools[conn.Upstream].Get(upstreamServer)
+	if !pooled {
+		upstreamFd, err = w.connectUpstream(upstreamServer)
+		if err != nil {
+			logger.Error("Failed to connect to upstream server", "error", err)
+			return upstreamFailure(upstreamStatus(err), err)
+		}
+	}
+	conn.UpstreamPooled = pooled
+
+	if err := w.poller.Add(upstreamFd, unix.EPOLLIN|unix.EPOLLOUT|unix.EPOLLET); err != nil {
+		logger.Error("Failed to add upstream server to poller", "error", err)
+		w.socket.CloseSocket(upstreamFd)
+		return withStatus(parser.HTTPStatusCodeBadGateway, err)
+	}
+
+	conn.UpstreamFD = upstreamFd
+	conn.State = connection.StateConnectingUpstream
+	w.connections[upstreamFd] = conn
+	w.setTimeout(conn, connection.TimeoutUpstreamConnect)
+
+	return nil
+}
+
+// connectUpstream starts connecting to server, over TCP or its Unix socket.
+func (w *worker) connectUpstream(server entity.UpstreamServer) (int, error) {
+	address, port := socket.UnixPrefix+server.SocketPath, 0
+	if server.SocketPath == "" {
+		address = server.URL.Hostname()
+		port, _ = strconv.Atoi(server.URL.Port())
+	}
+
+	fd, sa, err := w.socket.CreateClientSocket(address, port)
+	if err != nil {
+		return -1, err
+	}
+	if err := w.poller.Connect(fd, sa); err != nil && err != unix.EINPROGRESS {
+		w.poller.Remove(fd)
+		w.socket.CloseSocket(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func (w *worker) handleForwardUpstream(fd int) error {
+	conn, exists := w.connections[fd]
+
+	if !exists {
+		return fmt.Errorf("connection not found for fd %d", fd)
+	}
+
+	if conn.State != connection.StateConnectingUpstream && conn.State != connection.StateForwardingRequest {
+		return nil
+	}
+
+	if conn.State == connection.StateConnectingUpstream {
+		// The first EPOLLOUT only means the non-blocking connect finished;
+		// the socket's pending error tells whether it actually succeeded.
+		if err := w.socketError(conn.UpstreamFD); err != nil {
+			return upstreamFailure(upstreamStatus(err), err)
+		}
+		logger.Debug("Forwarding request to upstream", "client_fd", conn.ClientFD, "upstream_fd", conn.UpstreamFD, "upstream_host", conn.UpstreamServer.URL.Host)
+		conn.State = connection.StateForwardingRequest
+	}
+
+	buf := make([]byte, readBufferSize)
+
+	for {
+		// Flush whatever is queued before pulling more body from the client,
+		// so a slow upstream applies backpressure to the client socket.
+		if len(conn.UpstreamBuffer) > 0 {
+			n, err := w.poller.Write(conn.UpstreamFD, conn.UpstreamBuffer)
+			if err != nil {
+				if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+					w.setTimeout(conn, connection.TimeoutSend)
+					return nil
+				}
+				if err == unix.EINTR {
+					continue
+				}
+				logger.Error("Failed to write to upstream server", "error", err)
+				return upstreamFailure(parser.HTTPStatusCodeBadGateway, err)
+			}
+			conn.UpstreamBuffer = conn.UpstreamBuffer[n:]
+			conn.UpstreamBytesSent += int64(n)
+			continue
+		}
+
+		if conn.RequestParser.Complete() {
+			break
+		}
+
+		n, err := w.poller.Read(conn.ClientFD, buf)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+				w.setTimeout(conn, connection.TimeoutClientBody)
+				return nil
+			}
+			if err == unix.EINTR {
+				continue
+			}
+			logger.Error("Failed to read request body from client", "error", err)
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("client closed connection before the end of the request body")
+		}
+
+		consumed, err := w.queueRequestBody(conn, buf[:n])
+		if err != nil {
+			logger.Error("Failed to parse HTTP request body", "error", err)
+			return err
+		}
+		// Anything past the end of the body is the client's next, pipelined
+		// request.
+		conn.ReadBuffer = append(conn.ReadBuffer, buf[consumed:n]...)
+	}
+
+	conn.UpstreamBuffer = nil
+	conn.State = connection.StateWaitingResponse
+	w.setTimeout(conn, connection.TimeoutUpstreamRead)
+
+	return nil
+}
+
+// queueRequestBody appends the part of data that belongs to the current
+// request body to conn.UpstreamBuffer, framing included, and returns how many
+// bytes that was.
+func (w *worker) queueRequestBody(conn *connection.Connection, data []byte) (int, error) {
+	consumed := 0
+	for {
+		event, n, err := conn.RequestParser.Feed(data[consumed:])
+		consumed += n
+		if err != nil {
+			return consumed, withStatus(parser.HTTPStatusCodeBadRequest, err)
+		}
+		if event.Type == parser.EventBodyChunk {
+			conn.RequestBodySize += int64(event.End - event.Start)
+			if max := w.config.Server.ClientMaxBodySize; max > 0 && conn.RequestBodySize > max {
+				return consumed, withStatus(parser.HTTPStatusCodeContentTooLarge, fmt.Errorf("request body exceeds client_max_body_size"))
+			}
+		}
+		if event.Type == parser.EventNeedMore || event.Type == parser.EventMessageComplete {
+			break
+		}
+	}
+
+	conn.UpstreamBuffer = append(conn.UpstreamBuffer, data[:consumed]...)
+	return consumed, nil
+}
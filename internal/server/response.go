@@ -0,0 +1,302 @@
+//go:build linux
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stanleydv12/ginx/internal/connection"
+	"github.com/stanleydv12/ginx/internal/entity"
+	"github.com/stanleydv12/ginx/internal/parser"
+	"github.com/stanleydv12/ginx/pkg/logger"
+
+	"golang.org/x/sys/unix"
+)
+
+// relayResponse pumps the upstream response to the client and tears the
+// connection down once it has been fully delivered or has failed.
+func (w *worker) relayResponse(conn *connection.Connection) {
+	if err := w.handleUpstreamResponse(conn.UpstreamFD); err != nil {
+		logger.Error("Failed to handle upstream response", "error", err)
+		w.failRequest(conn, err)
+		return
+	}
+	if conn.State != connection.StateCompleted {
+		return
+	}
+
+	w.releaseUpstream(conn)
+	if !conn.KeepAlive {
+		w.cleanupConnection(conn.ClientFD)
+		return
+	}
+	w.finishRequest(conn)
+}
+
+func (w *worker) handleUpstreamResponse(upstreamFd int) error {
+	conn, exists := w.connections[upstreamFd]
+
+	if !exists {
+		return fmt.Errorf("connection not found for fd %d", upstreamFd)
+	}
+
+	if conn.ResponseParser == nil {
+		conn.ResponseParser = parser.NewResponseParser(conn.Request.Method, maxHeaderSize)
+	}
+
+	buf := make([]byte, readBufferSize)
+
+	for {
+		// Only pull more from the upstream once the client has caught up, so
+		// a slow client applies backpressure instead of growing the buffer.
+		if len(conn.ClientBuffer) > 0 {
+			n, err := w.poller.Write(conn.ClientFD, conn.ClientBuffer)
+			if err != nil {
+				if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+					w.setTimeout(conn, connection.TimeoutSend)
+					return w.setClientWriteBlocked(conn, true)
+				}
+				if err == unix.EINTR {
+					continue
+				}
+				logger.Error("Failed to write to client", "error", err)
+				return err
+			}
+			conn.ClientBuffer = conn.ClientBuffer[n:]
+			conn.BytesSent += int64(n)
+			continue
+		}
+
+		if err := w.setClientWriteBlocked(conn, false); err != nil {
+			return err
+		}
+
+		if conn.ResponseParser.Complete() {
+			break
+		}
+
+		n, err := w.poller.Read(upstreamFd, buf)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+				// While the request body is still being forwarded, the
+				// client body timeout is the one that applies.
+				if conn.State != connection.StateForwardingRequest {
+					w.setTimeout(conn, connection.TimeoutUpstreamRead)
+				}
+				return nil
+			}
+			if err == unix.EINTR {
+				continue
+			}
+			logger.Error("Failed to read from socket", "error", err)
+			return upstreamFailure(upstreamStatus(err), err)
+		}
+
+		if n == 0 {
+			if err := conn.ResponseParser.Finish(); err != nil {
+				return upstreamFailure(parser.HTTPStatusCodeBadGateway, fmt.Errorf("upstream %v", err))
+			}
+			if conn.ChunkResponse {
+				conn.ClientBuffer = parser.AppendLastChunk(conn.ClientBuffer, entity.Header{})
+			}
+			conn.UpstreamReusable = false
+			continue
+		}
+
+		conn.UpstreamBytesReceived += int64(n)
+		if err := w.queueResponse(conn, buf[:n]); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Request completed", "client_fd", conn.ClientFD, "status_code", conn.Response.StatusCode, "bytes_sent", conn.BytesSent)
+
+	conn.State = connection.StateCompleted
+
+	return nil
+}
+
+// queueResponse feeds bytes read from the upstream through the response
+// parser and appends what the client should see to conn.ClientBuffer: the
+// rewritten header block, then the body with whatever re-framing the client
+// needs.
+func (w *worker) queueResponse(conn *connection.Connection, data []byte) error {
+	for len(data) > 0 {
+		inBody := conn.ResponseParser.HeadersDone()
+
+		event, n, err := conn.ResponseParser.Feed(data)
+		if err != nil {
+			logger.Error("Failed to parse HTTP response", "error", err)
+			return withStatus(parser.HTTPStatusCodeBadGateway, err)
+		}
+
+		switch {
+		case event.Type == parser.EventHeadersComplete:
+			if err := w.handleResponseHeader(conn); err != nil {
+				return err
+			}
+		case !inBody:
+		case conn.DechunkResponse:
+			if event.Type == parser.EventBodyChunk {
+				conn.ClientBuffer = append(conn.ClientBuffer, data[event.Start:event.End]...)
+			}
+		case conn.ChunkResponse:
+			if event.Type == parser.EventBodyChunk {
+				conn.ClientBuffer = parser.AppendChunk(conn.ClientBuffer, data[event.Start:event.End])
+			}
+		default:
+			// Relay the body verbatim, chunk framing included.
+			conn.ClientBuffer = append(conn.ClientBuffer, data[:n]...)
+		}
+
+		data = data[n:]
+
+		if conn.ResponseParser.Complete() {
+			if len(data) > 0 {
+				// The upstream sent more than the response it framed.
+				conn.UpstreamReusable = false
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// handleResponseHeader queues the response header block that the response
+// parser just completed, rewritten, for the client. Interim 1xx responses are
+// relayed as-is and the parser is reset for the final response.
+func (w *worker) handleResponseHeader(conn *connection.Connection) error {
+	response := conn.ResponseParser.Response()
+
+	if response.StatusCode >= 100 && response.StatusCode < 200 && response.StatusCode != 101 {
+		conn.ClientBuffer = append(conn.ClientBuffer, conn.ResponseParser.Header()...)
+		conn.ResponseParser.Reset()
+		return nil
+	}
+
+	logger.Debug("Received response from upstream", "upstream_fd", conn.UpstreamFD, "client_fd", conn.ClientFD, "status_code", response.StatusCode)
+
+	bodyLength := conn.ResponseParser.BodyLength()
+
+	// Modify Response Headers
+	response.Headers.Set("Server", "ginx")
+	response.Headers.Add("Via", "ginx/1.0")
+
+	switch {
+	case bodyLength == parser.BodyChunked:
+		// Transfer-Encoding overrides Content-Length; relaying both would
+		// leave the client to pick one.
+		response.Headers.Del("Content-Length")
+		if conn.Request.Protocol != parser.HTTPProtocolHTTP11 {
+			conn.DechunkResponse = true
+			response.Headers.Del("Transfer-Encoding")
+		}
+	case bodyLength == parser.BodyUntilClose && conn.Request.Protocol == parser.HTTPProtocolHTTP11:
+		conn.ChunkResponse = true
+		response.Headers.Add("Transfer-Encoding", "chunked")
+	}
+
+	conn.KeepAlive = w.shouldKeepAlive(conn, bodyLength)
+	conn.UpstreamReusable = isUpstreamReusable(conn.Request, response, bodyLength)
+	if conn.KeepAlive {
+		response.Headers.Set("Connection", "keep-alive")
+	} else {
+		response.Headers.Set("Connection", "close")
+	}
+
+	conn.Response = response
+	conn.ClientBuffer = append(conn.ClientBuffer, w.httpParser.RebuildResponse(response)...)
+	conn.State = connection.StateSendingResponse
+
+	return nil
+}
+
+// releaseUpstream detaches the upstream fd of a completed request from the
+// client connection, returning it to the pool when it can be reused, and
+// tells the load balancer the request is over.
+func (w *worker) releaseUpstream(conn *connection.Connection) {
+	if conn.UpstreamFD != 0 {
+		delete(w.connections, conn.UpstreamFD)
+		w.poller.Remove(conn.UpstreamFD)
+		requestSent := conn.RequestParser.Complete() && len(conn.UpstreamBuffer) == 0
+		if conn.UpstreamReusable && requestSent && conn.State == connection.StateCompleted {
+			w.pools[conn.Upstream].Put(conn.UpstreamServer, conn.UpstreamFD)
+		} else {
+			w.socket.CloseSocket(conn.UpstreamFD)
+		}
+		conn.UpstreamFD = 0
+	}
+	w.releaseServer(conn)
+}
+
+// releaseServer reports the end of the current request to the load balancer,
+// exactly once for every server it handed out.
+func (w *worker) releaseServer(conn *connection.Connection) {
+	if conn.UpstreamServer.URL == nil {
+		return
+	}
+	if loadBalancer, exists := w.upstreams.Get(conn.Upstream); exists {
+		loadBalancer.Done(conn.UpstreamServer)
+	}
+	conn.UpstreamServer = entity.UpstreamServer{}
+}
+
+// finishRequest loops the client connection of a completed request back to
+// StateClientAccepted for its next request.
+func (w *worker) finishRequest(conn *connection.Connection) {
+	conn.ResetForNextRequest()
+	if len(conn.ReadBuffer) > 0 {
+		w.setTimeout(conn, connection.TimeoutClientHeader)
+	} else {
+		w.setTimeout(conn, connection.TimeoutKeepAlive)
+	}
+
+	// The client may already have pipelined its next request; with EPOLLET
+	// no new event will arrive for bytes that are already buffered.
+	w.handleClientEvent(conn, unix.EPOLLIN)
+}
+
+// shouldKeepAlive decides whether the client connection can be reused after
+// the current response, following HTTP/1.0 and HTTP/1.1 persistence rules.
+func (w *worker) shouldKeepAlive(conn *connection.Connection, responseBodyLength int64) bool {
+	// Without framing the client can only find the end of the body by the
+	// connection closing.
+	if conn.DechunkResponse || (responseBodyLength == parser.BodyUntilClose && !conn.ChunkResponse) {
+		return false
+	}
+	// Unread request body bytes would be mistaken for the next request.
+	if !conn.RequestParser.Complete() {
+		return false
+	}
+	if conn.Requests >= w.config.Server.KeepAliveRequests {
+		return false
+	}
+
+	if conn.Request.Protocol == parser.HTTPProtocolHTTP11 {
+		return !hasConnectionToken(conn.Request.Headers, "close")
+	}
+	return hasConnectionToken(conn.Request.Headers, "keep-alive")
+}
+
+// isUpstreamReusable reports whether the upstream will keep its side of the
+// connection open after this response, so it can be pooled.
+func isUpstreamReusable(req entity.HTTPRequest, resp entity.HTTPResponse, responseBodyLength int64) bool {
+	if responseBodyLength == parser.BodyUntilClose || resp.StatusCode == 101 || resp.Protocol != parser.HTTPProtocolHTTP11 {
+		return false
+	}
+	return !hasConnectionToken(req.Headers, "close") && !hasConnectionToken(resp.Headers, "close")
+}
+
+// hasConnectionToken reports whether the Connection header lists token.
+func hasConnectionToken(headers entity.Header, token string) bool {
+	for _, field := range headers.Values("Connection") {
+		for _, value := range strings.Split(field, ",") {
+			if strings.EqualFold(strings.TrimSpace(value), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/stanleydv12/ginx/internal/config"
+	"github.com/stanleydv12/ginx/internal/connection"
+	"github.com/stanleydv12/ginx/internal/parser"
+	"github.com/stanleydv12/ginx/pkg/logger"
+)
+
+// upstreamError marks a failure of the upstream server itself, as opposed to
+// the client or ginx, so it counts against the server and may be retried.
+type upstreamError struct {
+	err error
+}
+
+func (e *upstreamError) Error() string {
+	return e.err.Error()
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
+
+// upstreamFailure wraps an upstream failure with the status the client should
+// be answered with if the request is not retried.
+func upstreamFailure(statusCode int, err error) error {
+	return withStatus(statusCode, &upstreamError{err: err})
+}
+
+// retryRequest reports a failed upstream to the health checker and, when the
+// retry policy allows, sends the request to another server instead. It
+// reports whether the request was retried.
+func (w *worker) retryRequest(conn *connection.Connection, err error) bool {
+	var upstreamErr *upstreamError
+	if !errors.As(err, &upstreamErr) || conn.UpstreamServer.URL == nil {
+		return false
+	}
+
+	// An idle pooled connection that fails before answering was most likely
+	// closed by the server while it sat in the pool. That says nothing about
+	// the server, and a new connection to it deserves its own try.
+	var statusErr *statusError
+	timedOut := errors.As(err, &statusErr) && statusErr.statusCode == parser.HTTPStatusCodeGatewayTimeout
+	stale := conn.UpstreamPooled && conn.UpstreamBytesReceived == 0 && !timedOut
+	if !stale {
+		w.health[conn.Upstream].ReportFailure(conn.UpstreamServer)
+		conn.TriedServers = append(conn.TriedServers, conn.UpstreamServer)
+	}
+
+	if !w.retryable(conn) {
+		return false
+	}
+	if !w.retryBudget.allow(time.Now()) {
+		logger.Error("Retry budget exhausted, not retrying request", "client_fd", conn.ClientFD, "upstream_host", conn.UpstreamServer.URL.Host)
+		return false
+	}
+
+	logger.Info("Retrying request on another upstream", "client_fd", conn.ClientFD, "upstream_host", conn.UpstreamServer.URL.Host, "tries", len(conn.TriedServers), "error", upstreamErr.err)
+
+	// Drop the header rewritten for the failed server. If nothing was sent,
+	// the body bytes queued behind it go to the next server; otherwise the
+	// request has no body and everything is rebuilt.
+	if conn.UpstreamBytesSent == 0 {
+		conn.UpstreamBuffer = conn.UpstreamBuffer[conn.RequestHeaderSize:]
+	} else {
+		conn.UpstreamBuffer = nil
+	}
+	conn.UpstreamReusable = false
+	w.releaseUpstream(conn)
+	conn.ResponseParser = nil
+	conn.UpstreamPooled = false
+	conn.UpstreamBytesSent = 0
+	conn.UpstreamBytesReceived = 0
+	conn.State = connection.StateRequestReceived
+
+	if retryErr := w.handleConnectUpstream(conn.ClientFD); retryErr != nil {
+		// With no other server left, the client is told about the failure
+		// that made us retry rather than about the retry.
+		var retryStatusErr *statusError
+		if errors.As(retryErr, &retryStatusErr) && retryStatusErr.statusCode == parser.HTTPStatusCodeServiceUnavailable {
+			retryErr = err
+		}
+		w.failRequest(conn, retryErr)
+	}
+	return true
+}
+
+// retryable reports whether the request on conn may be sent again. That is
+// only safe while the client has seen nothing of the response, and either
+// nothing reached the failed server or the request is idempotent and can be
+// rebuilt in full, which excludes requests with a body.
+func (w *worker) retryable(conn *connection.Connection) bool {
+	if w.config.Server.Retries.Tries <= 1 || len(conn.TriedServers) >= w.config.Server.Retries.Tries {
+		return false
+	}
+	if conn.UpstreamBytesReceived > 0 || conn.BytesSent > 0 || len(conn.ClientBuffer) > 0 {
+		return false
+	}
+	if conn.UpstreamBytesSent == 0 {
+		return true
+	}
+	return isIdempotent(conn.Request.Method) && conn.RequestParser.BodyLength() == 0 && conn.RequestParser.Complete()
+}
+
+// isIdempotent reports whether repeating a request with the given method has
+// the same effect as sending it once.
+func isIdempotent(method string) bool {
+	switch method {
+	case parser.HTTPMethodGet, parser.HTTPMethodHead, parser.HTTPMethodPut, parser.HTTPMethodDelete, parser.HTTPMethodOptions, "TRACE":
+		return true
+	}
+	return false
+}
+
+// retryBudget caps retries at a fraction of the requests received, plus a
+// fixed number per second, so that retries cannot multiply the load on
+// upstreams that are already failing. It is shared by all workers.
+type retryBudget struct {
+	ratio        float64
+	minPerSecond int
+
+	mu sync.Mutex
+	// window is the start of the second that requests and retries count.
+	window   time.Time
+	requests int
+	retries  int
+}
+
+func newRetryBudget(cfg config.RetryConfig) *retryBudget {
+	return &retryBudget{
+		ratio:        cfg.BudgetRatio,
+		minPerSecond: cfg.MinRetriesPerSecond,
+	}
+}
+
+// request counts a request received from a client.
+func (b *retryBudget) request(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance(now)
+	b.requests++
+}
+
+// allow reports whether a retry fits in the budget, and if so spends it.
+func (b *retryBudget) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance(now)
+	if float64(b.retries) >= float64(b.minPerSecond)+b.ratio*float64(b.requests) {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// advance starts a new window once the current one is a second old.
+func (b *retryBudget) advance(now time.Time) {
+	if now.Sub(b.window) >= time.Second {
+		b.window = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
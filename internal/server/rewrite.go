@@ -0,0 +1,166 @@
+//go:build linux
+
+package server
+
+import (
+	"net"
+	"strings"
+
+	"github.com/stanleydv12/ginx/internal/config"
+	"github.com/stanleydv12/ginx/internal/connection"
+	"github.com/stanleydv12/ginx/internal/entity"
+	"github.com/stanleydv12/ginx/internal/socket"
+	"github.com/stanleydv12/ginx/pkg/logger"
+)
+
+// rewriteRequest applies the proxy's header rewrites to a copy of the client
+// request and returns the header block to send upstream. The body is not
+// included; it is streamed after the header exactly as the client framed it.
+// conn.Request is left as the client sent it, so that a retry rewrites it
+// afresh for the next server.
+func (w *worker) rewriteRequest(conn *connection.Connection) []byte {
+	req := conn.Request
+	req.Headers = req.Headers.Clone()
+	req.Body = nil
+
+	originalHost := req.Headers.Get("Host")
+	if !w.config.Server.PreserveHost {
+		req.Headers.Set("Host", upstreamHost(conn.UpstreamServer))
+	}
+
+	peerIP := clientIP(conn.ClientAddress)
+	trusted := w.isTrustedProxy(peerIP)
+
+	// Forwarding headers from anyone but a trusted proxy are made up by the
+	// client, so the chain starts over at the peer we actually talked to.
+	var forwardedFor []string
+	if trusted {
+		forwardedFor = splitList(req.Headers.Values("X-Forwarded-For"))
+	}
+	forwardedFor = append(forwardedFor, peerIP)
+	req.Headers.Set("X-Forwarded-For", strings.Join(forwardedFor, ", "))
+	req.Headers.Set("X-Real-IP", w.realClientIP(forwardedFor))
+
+	if !trusted || !req.Headers.Has("X-Forwarded-Proto") {
+		req.Headers.Set("X-Forwarded-Proto", "http")
+	}
+
+	element := forwardedElement(peerIP, originalHost, "http")
+	if forwarded := strings.Join(req.Headers.Values("Forwarded"), ", "); trusted && forwarded != "" {
+		req.Headers.Set("Forwarded", forwarded+", "+element)
+	} else {
+		req.Headers.Set("Forwarded", element)
+	}
+
+	return w.httpParser.RebuildRequest(req)
+}
+
+// upstreamHost is the Host header sent to server. A Unix socket has no host
+// name, so its servers get "localhost".
+func upstreamHost(server entity.UpstreamServer) string {
+	if server.SocketPath != "" {
+		return "localhost"
+	}
+	return server.URL.Host
+}
+
+// parseTrustedProxies parses server.trusted_proxies. LoadConfig has already
+// rejected invalid entries, so an error here is only logged.
+func parseTrustedProxies(entries []string) []*net.IPNet {
+	networks, err := config.ParseTrustedProxies(entries)
+	if err != nil {
+		logger.Error("Invalid trusted proxies", "error", err)
+	}
+	return networks
+}
+
+// requestClientIP returns the address of the client that sent the request,
+// looking through X-Forwarded-For when the peer is a trusted proxy.
+func (w *worker) requestClientIP(conn *connection.Connection) string {
+	peerIP := clientIP(conn.ClientAddress)
+	if !w.isTrustedProxy(peerIP) {
+		return peerIP
+	}
+	forwardedFor := append(splitList(conn.Request.Headers.Values("X-Forwarded-For")), peerIP)
+	return w.realClientIP(forwardedFor)
+}
+
+// realClientIP walks the X-Forwarded-For chain from the nearest hop back and
+// returns the first address that is not a trusted proxy.
+func (w *worker) realClientIP(forwardedFor []string) string {
+	for i := len(forwardedFor) - 1; i > 0; i-- {
+		if !w.isTrustedProxy(forwardedFor[i]) {
+			return forwardedFor[i]
+		}
+	}
+	return forwardedFor[0]
+}
+
+// isTrustedProxy reports whether address belongs to server.trusted_proxies.
+func (w *worker) isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range w.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP strips the port from a host:port client address. Clients of a
+// Unix socket are left as they are.
+func clientIP(address string) string {
+	if strings.HasPrefix(address, socket.UnixPrefix) {
+		return address
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+// splitList splits comma-separated header values into their elements.
+func splitList(values []string) []string {
+	var elements []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				elements = append(elements, element)
+			}
+		}
+	}
+	return elements
+}
+
+// forwardedElement builds one element of an RFC 7239 Forwarded header
+// describing the hop from the client to us.
+func forwardedElement(clientIP, host, proto string) string {
+	var pairs []string
+	if clientIP != "" {
+		// Clients of a Unix socket have no address to tell.
+		if ip := net.ParseIP(clientIP); ip == nil {
+			clientIP = "unknown"
+		} else if ip.To4() == nil {
+			clientIP = "[" + clientIP + "]"
+		}
+		pairs = append(pairs, "for="+forwardedValue(clientIP))
+	}
+	if host != "" {
+		pairs = append(pairs, "host="+forwardedValue(host))
+	}
+	pairs = append(pairs, "proto="+proto)
+	return strings.Join(pairs, ";")
+}
+
+// forwardedValue quotes a Forwarded parameter value when it is not a valid
+// token, which is the case for IPv6 addresses and anything with a port.
+func forwardedValue(value string) string {
+	if strings.ContainsAny(value, ":[]\" ") {
+		return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+	}
+	return value
+}
@@ -3,105 +3,153 @@
 package server
 
 import (
-	"github.com/stanleydv12/ginx/internal/async/epoll"
 	"github.com/stanleydv12/ginx/internal/config"
 	"github.com/stanleydv12/ginx/internal/connection"
+	"github.com/stanleydv12/ginx/internal/errorpage"
+	"github.com/stanleydv12/ginx/internal/healthcheck"
 	"github.com/stanleydv12/ginx/internal/loadbalancer"
 	"github.com/stanleydv12/ginx/internal/parser"
 	"github.com/stanleydv12/ginx/internal/socket"
 	"github.com/stanleydv12/ginx/pkg/logger"
 
-	"fmt"
-	"strconv"
+	"errors"
 	"golang.org/x/sys/unix"
+	"net"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	// readBufferSize is the size of a single read from a socket.
+	readBufferSize = 4096
+	// maxHeaderSize bounds how much we buffer while waiting for the end of
+	// the request header block.
+	maxHeaderSize = 64 * 1024
+	// idleSweepInterval is how often idle pooled upstream connections are
+	// checked for expiry, and therefore the longest the event loop blocks.
+	idleSweepInterval = time.Second
+)
+
+// errClientClosed is returned when a client closes its connection between
+// requests, which is the normal end of a keep-alive connection.
+var errClientClosed = errors.New("client closed connection")
+
+// Server owns what all workers share: the configuration, the listeners and
+// their virtual hosts, the registry of the upstream groups' balancers, their
+// health checkers, the retry budget and the error pages. Each worker runs its
+// own event loop.
 type Server struct {
-	listenFd     int
-	config       config.ServerConfig
-	socket       socket.SocketManager
-	epoll        epoll.EpollHandler
-	httpParser   parser.HTTPParser
-	loadBalancer loadbalancer.LoadBalancerHandler
-	connections map[int]*connection.Connection
+	config     config.ServerConfig
+	socket     socket.SocketManager
+	httpParser parser.HTTPParser
+	listeners  []*listener
+	upstreams  loadbalancer.LoadBalancerRegistry
+	// health holds the health checker of each upstream group.
+	health      map[string]healthcheck.HealthCheckHandler
+	retryBudget *retryBudget
+	errorPages  errorpage.ErrorPageHandler
+	// trustedProxies are the networks whose forwarding headers we keep.
+	trustedProxies []*net.IPNet
+	workers        []*worker
+	// stopping tells the workers to leave their event loops.
+	stopping atomic.Bool
 }
 
-func NewServer(config config.ServerConfig, socket socket.SocketManager, epoll epoll.EpollHandler, httpParser parser.HTTPParser, loadBalancer loadbalancer.LoadBalancerHandler) *Server {
+func NewServer(config config.ServerConfig, socket socket.SocketManager, httpParser parser.HTTPParser, virtualHosts []*VirtualHost, upstreams loadbalancer.LoadBalancerRegistry, health map[string]healthcheck.HealthCheckHandler, errorPages errorpage.ErrorPageHandler) *Server {
 	return &Server{
-		config:       config,
-		socket:       socket,
-		epoll:        epoll,
-		httpParser:   httpParser,
-		loadBalancer: loadBalancer,
-		connections:  make(map[int]*connection.Connection),
+		config:         config,
+		socket:         socket,
+		httpParser:     httpParser,
+		listeners:      newListeners(virtualHosts),
+		upstreams:      upstreams,
+		health:         health,
+		retryBudget:    newRetryBudget(config.Server.Retries),
+		errorPages:     errorPages,
+		trustedProxies: parseTrustedProxies(config.Server.TrustedProxies),
 	}
 }
 
+// Start binds the listeners of every worker and runs the workers' event loops
+// until one of them fails or the server is stopped.
 func (s *Server) Start() error {
-	// Test open and close socket
-	fd, err := s.socket.CreateSocket(nil)
-	if err != nil {
-		logger.Error("Failed to create socket", "error", err)
-		return err
+	for _, l := range s.listeners {
+		if path, ok := socket.UnixPath(l.config.Address); ok {
+			if err := s.listenUnix(l, path); err != nil {
+				return err
+			}
+			defer s.closeUnixListener(l, path)
+		}
 	}
 
-	if err := s.socket.BindSocket(fd, s.config.Server.Address, s.config.Server.Port); err != nil {
-		logger.Error("Failed to bind socket", "error", err)
-		return err
+	workers := s.config.Server.Workers
+	for i := 0; i < workers; i++ {
+		w, err := newWorker(s, i)
+		if err != nil {
+			logger.Error("Failed to create worker", "worker", i, "error", err)
+			s.stopIdleWorkers()
+			return err
+		}
+		s.workers = append(s.workers, w)
+		if err := w.listen(workers > 1); err != nil {
+			s.stopIdleWorkers()
+			return err
+		}
 	}
 
-	logger.Info("Server started and listening", "address", fmt.Sprintf("%s:%d", s.config.Server.Address, s.config.Server.Port), "fd", fd)
-	if err := s.socket.StartListening(fd); err != nil {
-		logger.Error("Failed to listen on socket", "error", err)
-		return err
+	addresses := make([]string, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addresses = append(addresses, listenAddress(l.config))
 	}
-	s.listenFd = fd
+	logger.Info("Server started and listening", "addresses", addresses, "workers", workers)
 
-	if err := s.epoll.Add(s.listenFd, unix.EPOLLIN); err != nil {
-		logger.Error("Failed to add socket to epoll", "error", err)
-		return err
+	errs := make(chan error, len(s.workers))
+	for _, w := range s.workers {
+		go func(w *worker) {
+			errs <- w.run()
+		}(w)
 	}
 
-	for {
-		events, err := s.epoll.Wait()
-		if err != nil {
-			if err == unix.EINTR {
-				continue
-			}
-			logger.Error("Failed to wait for events", "error", err)
-			return err
-		}
-
-		for _, event := range events {
-			s.handleEvent(event)
+	// The first worker to fail brings the others down with it.
+	var err error
+	for range s.workers {
+		if workerErr := <-errs; workerErr != nil && err == nil {
+			err = workerErr
+			s.Stop()
 		}
 	}
+	return err
 }
 
-func (s *Server) Stop() {
-	if err := s.epoll.Remove(s.listenFd); err != nil {
-		logger.Error("Failed to remove socket from epoll", "error", err)
+// stopIdleWorkers releases the sockets and pollers of workers whose event
+// loops never started, when Start fails half way.
+func (s *Server) stopIdleWorkers() {
+	for _, w := range s.workers {
+		w.stop()
 	}
+	s.workers = nil
+}
 
-	if err := s.socket.CloseSocket(s.listenFd); err != nil {
-		logger.Error("Failed to close socket", "error", err)
-	}
+// Stop asks the workers to leave their event loops, which they do within
+// idleSweepInterval. Start returns once they all have. It is safe to call
+// from any goroutine.
+func (s *Server) Stop() {
+	s.stopping.Store(true)
 }
 
-func (s *Server) handleEvent(event unix.EpollEvent) {
+func (w *worker) handleEvent(event unix.EpollEvent) {
 	fd := int(event.Fd)
 	eventType := event.Events
 
-	if fd == s.listenFd {
+	if listener, isListener := w.listenFds[fd]; isListener {
 		if eventType&unix.EPOLLIN != 0 {
-			if err := s.handleNewConnection(); err != nil {
+			if err := w.handleNewConnection(fd, listener); err != nil {
 				logger.Error("Error accepting new client connection", "error", err, "fd", fd)
 			}
-			return
 		}
+		return
 	}
 
-	conn, exists := s.connections[fd]
+	conn, exists := w.connections[fd]
 	if !exists {
 		logger.Error("Connection not found while handling event", "fd", fd, "event_type", eventType)
 		return
@@ -109,54 +157,107 @@ func (s *Server) handleEvent(event unix.EpollEvent) {
 
 	if eventType&unix.EPOLLERR != 0 {
 		logger.Error("Socket error detected by epoll", "fd", fd, "event_type", "EPOLLERR")
-		if err := s.socket.CheckSocketState(fd); err != nil {
+		err := w.socketError(fd)
+		if err != nil {
 			logger.Error("Failed to check socket state", "error", err)
 		}
-		s.cleanupConnection(fd)
+		if fd == conn.UpstreamFD {
+			if err == nil {
+				err = errors.New("upstream socket error")
+			}
+			w.failRequest(conn, upstreamFailure(upstreamStatus(err), err))
+			return
+		}
+		w.cleanupConnection(fd)
 		return
 	}
 
 	if eventType&unix.EPOLLHUP != 0 {
-		logger.Error("Connection hangup detected by epoll", "fd", fd, "event_type", "EPOLLHUP")
-		if err := s.socket.CheckSocketState(fd); err != nil {
-			logger.Error("Failed to check socket state", "error", err)
+		// An upstream that hangs up after sending its response may still have
+		// unread bytes; let the read path drain them and observe EOF.
+		if fd == conn.UpstreamFD && isReadingResponse(conn.State) {
+			eventType |= unix.EPOLLIN
+		} else if fd == conn.UpstreamFD {
+			logger.Error("Upstream hung up before the request was sent", "fd", fd, "event_type", "EPOLLHUP")
+			err := w.socketError(fd)
+			if err == nil {
+				err = errors.New("upstream hung up")
+			}
+			w.failRequest(conn, upstreamFailure(upstreamStatus(err), err))
+			return
+		} else {
+			logger.Error("Connection hangup detected by epoll", "fd", fd, "event_type", "EPOLLHUP")
+			if err := w.socketError(fd); err != nil {
+				logger.Error("Failed to check socket state", "error", err)
+			}
+			w.cleanupConnection(fd)
+			return
 		}
-		s.cleanupConnection(fd)
-		return
 	}
 
+	if fd == conn.UpstreamFD {
+		w.handleUpstreamEvent(conn, eventType)
+	} else {
+		w.handleClientEvent(conn, eventType)
+	}
+}
+
+func (w *worker) handleClientEvent(conn *connection.Connection, eventType uint32) {
+	fd := conn.ClientFD
+
 	switch conn.State {
 	case connection.StateClientAccepted:
 		if eventType&unix.EPOLLIN != 0 {
-			if err := s.handleClientRequest(fd); err != nil {
-				logger.Error("Failed to handle client request", "fd", fd, "error", err)
-				s.cleanupConnection(fd)
+			if err := w.handleClientRequest(fd); err != nil {
+				w.failRequest(conn, err)
+				return
 			}
-			if err := s.handleConnectUpstream(fd); err != nil {
-				logger.Error("Failed to handle connect upstream", "fd", fd, "error", err)
-				s.cleanupConnection(fd)
+			if conn.State != connection.StateRequestReceived {
+				return
 			}
-		}
-	case connection.StateConnectingUpstream:
-		if eventType&unix.EPOLLOUT != 0 {
-			if err := s.handleForwardUpstream(fd); err != nil {
-				logger.Error("Failed to handle forward upstream", "error", err)
-				s.cleanupConnection(fd)
+			if err := w.handleConnectUpstream(fd); err != nil {
+				logger.Error("Failed to handle connect upstream", "fd", fd, "error", err)
+				w.failRequest(conn, err)
 			}
 		}
 	case connection.StateForwardingRequest:
 		if eventType&unix.EPOLLIN != 0 {
-			if err := s.handleUpstreamResponse(fd); err != nil {
-				logger.Error("Failed to handle upstream response", "error", err)
-				s.cleanupConnection(fd)
+			if err := w.handleForwardUpstream(fd); err != nil {
+				logger.Error("Failed to handle forward upstream", "error", err)
+				w.failRequest(conn, err)
 			}
-			s.cleanupConnection(fd)
 		}
+	case connection.StateSendingResponse:
+		if eventType&unix.EPOLLOUT != 0 {
+			w.relayResponse(conn)
+		}
+	case connection.StateError:
+		if eventType&unix.EPOLLOUT != 0 {
+			w.flushErrorResponse(conn)
+		}
+	}
+}
+
+func (w *worker) handleUpstreamEvent(conn *connection.Connection, eventType uint32) {
+	fd := conn.UpstreamFD
+
+	if eventType&unix.EPOLLOUT != 0 && (conn.State == connection.StateConnectingUpstream || conn.State == connection.StateForwardingRequest) {
+		if err := w.handleForwardUpstream(fd); err != nil {
+			logger.Error("Failed to handle forward upstream", "error", err)
+			w.failRequest(conn, err)
+			return
+		}
+	}
+
+	if eventType&unix.EPOLLIN != 0 && isReadingResponse(conn.State) {
+		w.relayResponse(conn)
 	}
 }
 
-func (s *Server) handleNewConnection() error {
-	connFd, err := s.socket.AcceptConnection(s.listenFd)
+// handleNewConnection accepts a client on listenFd, which belongs to the
+// listener with the given index.
+func (w *worker) handleNewConnection(listenFd int, listener int) error {
+	connFd, peer, err := w.poller.Accept(listenFd)
 	if err != nil {
 		if err == unix.EINTR || err == unix.EAGAIN || err == unix.EWOULDBLOCK {
 			return nil
@@ -169,214 +270,88 @@ func (s *Server) handleNewConnection() error {
 		return nil
 	}
 
-	if err := s.epoll.Add(connFd, unix.EPOLLIN|unix.EPOLLET); err != nil {
-		logger.Error("Failed to add connection to epoll", "fd", connFd, "error", err)
-		s.socket.CloseSocket(connFd)
+	clientAddress := socket.SockaddrString(peer)
+	if err := w.poller.Add(connFd, unix.EPOLLIN|unix.EPOLLET); err != nil {
+		logger.Error("Failed to add connection to poller", "fd", connFd, "error", err)
+		w.socket.CloseSocket(connFd)
 		return nil
 	}
 
-	s.connections[connFd] = &connection.Connection{
-		ClientFD: connFd,
-		State:    connection.StateClientAccepted,
+	conn := &connection.Connection{
+		ClientFD:      connFd,
+		ClientAddress: clientAddress,
+		Listener:      listener,
+		State:         connection.StateClientAccepted,
 	}
+	w.connections[connFd] = conn
+	w.setTimeout(conn, connection.TimeoutClientHeader)
 
-	logger.Info("New connection accepted", "fd", connFd)
+	logger.Info("New connection accepted", "fd", connFd, "client_address", clientAddress)
 	return nil
 }
 
-func (s *Server) handleClientRequest(clientFd int) error {
-	logger.Debug("Processing client request", "client_fd", clientFd)
-
-	conn, exists := s.connections[clientFd]
-
-	if !exists {
-		return fmt.Errorf("connection not found for fd %d", clientFd)
-	}
-
-	buf := make([]byte, 4096)
-
-	n, err := s.socket.ReadFromSocket(clientFd, buf)
-	if err != nil {
-		if err == unix.EINTR {
-			logger.Info("handleClientRequest: EINTR", "fd", clientFd)
-			return nil
-		}
-		logger.Error("Failed to read from socket", "error", err)
-		return err
-	}
-
-	req, err := s.httpParser.ParseHTTPRequest(buf[:n])
-	if err != nil {
-		logger.Error("Failed to parse HTTP request", "error", err)
-		return err
-	}
-
-	conn.ClientAddress = req.Headers["Host"]
-	conn.Request = req
-	conn.State = connection.StateRequestReceived
-	s.connections[clientFd] = conn
-
-	logger.Info("HTTP request received", "client_fd", clientFd, "method", req.Method, "path", req.Path, "host", req.Headers["Host"])
-
-	return nil
+// isReadingResponse reports whether the upstream may be sending response
+// bytes in the given state. Upstreams are allowed to answer before the
+// request body has been fully forwarded.
+func isReadingResponse(state connection.ConnectionState) bool {
+	return state == connection.StateForwardingRequest ||
+		state == connection.StateWaitingResponse ||
+		state == connection.StateSendingResponse
 }
 
-func (s *Server) handleConnectUpstream(clientFd int) error {
-	conn, exists := s.connections[clientFd]
-
-	if !exists {
-		return fmt.Errorf("connection not found for fd %d", clientFd)
-	}
-
-	logger.Debug("Initiating upstream connection", "client_fd", clientFd)
-
-	upstreamServer, err := s.loadBalancer.SelectServer()
-	if err != nil {
-		logger.Error("Failed to select upstream server", "error", err)
-		return err
+// setClientWriteBlocked arms or disarms EPOLLOUT on the client fd so we are
+// woken up once a blocked client can accept more response bytes.
+func (w *worker) setClientWriteBlocked(conn *connection.Connection, blocked bool) error {
+	if conn.ClientWriteBlocked == blocked {
+		return nil
 	}
 
-	logger.Debug("Selected upstream server for request", "client_fd", clientFd, "upstream_host", upstreamServer.URL.Host)
-
-	// Change headers
-	conn.Request.Headers["Host"] = upstreamServer.URL.Host
-
-	address := upstreamServer.URL.Hostname()
-	port, _ := strconv.Atoi(upstreamServer.URL.Port())
-
-	upstreamFd, err := s.socket.ConnectToSocket(address, port)
-	if err != nil {
-		logger.Error("Failed to connect to upstream server", "error", err)
-		return err
+	events := uint32(unix.EPOLLIN | unix.EPOLLET)
+	if blocked {
+		events |= unix.EPOLLOUT
 	}
-
-	if err := s.epoll.Add(upstreamFd, unix.EPOLLOUT|unix.EPOLLET); err != nil {
-		logger.Error("Failed to add upstream server to epoll", "error", err)
+	if err := w.poller.Modify(conn.ClientFD, events); err != nil {
+		logger.Error("Failed to modify client connection in poller", "fd", conn.ClientFD, "error", err)
 		return err
 	}
 
-	conn.UpstreamFD = upstreamFd
-	conn.UpstreamServer = upstreamServer
-	conn.State = connection.StateConnectingUpstream
-	s.connections[upstreamFd] = conn
-
+	conn.ClientWriteBlocked = blocked
 	return nil
 }
 
-func (s *Server) handleForwardUpstream(upstreamFd int) error {
-	conn, exists := s.connections[upstreamFd]
-
-	if !exists {
-		return fmt.Errorf("connection not found for fd %d", upstreamFd)
+// socketError returns the error pending on fd as a *socket.SocketError.
+func (w *worker) socketError(fd int) error {
+	if err := w.poller.SocketError(fd); err != nil {
+		return &socket.SocketError{FD: fd, Err: err}
 	}
-
-	logger.Debug("Forwarding request to upstream", "client_fd", conn.ClientFD, "upstream_fd", upstreamFd, "upstream_host", conn.UpstreamServer.URL.Host)
-
-	request := conn.Request
-
-	// Change header
-	request.Headers["Host"] = conn.UpstreamServer.URL.Host
-
-	_, err := s.socket.WriteToSocket(upstreamFd, request.Raw)
-	if err != nil {
-		logger.Error("Failed to write to upstream server", "error", err)
-		return err
-	}
-
-	if err := s.epoll.Modify(upstreamFd, unix.EPOLLIN); err != nil {
-		logger.Error("Failed to modify upstream server to epoll", "error", err)
-		return err
-	}
-
-	conn.State = connection.StateForwardingRequest
-	if s.connections[conn.ClientFD] != nil {
-		s.connections[conn.ClientFD].State = connection.StateForwardingRequest
-	}
-
 	return nil
 }
 
-func (s *Server) handleUpstreamResponse(upstreamFd int) error {
-	conn, exists := s.connections[upstreamFd]
-
+func (w *worker) cleanupConnection(fd int) {
+	conn, exists := w.connections[fd]
 	if !exists {
-		return fmt.Errorf("connection not found for fd %d", upstreamFd)
-	}
-
-	buf := make([]byte, 4096)
-
-	n, err := s.socket.ReadFromSocket(upstreamFd, buf)
-	if err != nil {
-		if err == unix.EINTR {
-			return nil
-		}
-		logger.Error("Failed to read from socket", "error", err)
-		return err
-	}
-
-	logger.Debug("Received response from upstream", "upstream_fd", upstreamFd, "client_fd", conn.ClientFD)
-
-	response, err := s.httpParser.ParseHTTPResponse(buf[:n])
-	if err != nil {
-		logger.Error("Failed to parse HTTP response", "error", err)
-		return err
+		logger.Error("Connection not found in cleanupConnection", "fd", fd)
+		return
 	}
 
-	conn.Response = response
-	conn.State = connection.StateWaitingResponse
-	if s.connections[conn.ClientFD] != nil {
-		s.connections[conn.ClientFD].State = connection.StateWaitingResponse
+	if conn.Closed {
+		return // Already cleaning up!
 	}
+	conn.Closed = true
 
-	// Modify Response Headers
-	response.Headers["Server"] = "ginx"
-	response.Headers["X-Forwarded-For"] = conn.ClientAddress
-	response.Headers["X-Forwarded-Proto"] = "http"
-	response.Headers["Via"] = "ginx/1.0"
-	response.Headers["Connection"] = "close"
-	response.Headers["Content-Length"] = strconv.Itoa(len(response.Body))
-
-	response.Raw = s.httpParser.RebuildResponse(response)
-
-	_, err = s.socket.WriteToSocket(conn.ClientFD, response.Raw)
-	if err != nil {
-		logger.Error("Failed to write to client", "error", err)
-		return err
+	// Now remove both sides from the map and close both fds
+	delete(w.connections, conn.ClientFD)
+	w.timers.Cancel(conn.ClientFD)
+	w.releaseServer(conn)
+	if conn.UpstreamFD != 0 {
+		delete(w.connections, conn.UpstreamFD)
 	}
 
-	logger.Info("Request completed", "client_fd", conn.ClientFD, "status_code", response.StatusCode, "content_length", len(response.Body))
-
-	conn.State = connection.StateCompleted
-	if s.connections[conn.ClientFD] != nil {
-		s.connections[conn.ClientFD].State = connection.StateCompleted
+	w.poller.Remove(conn.ClientFD)
+	w.socket.CloseSocket(conn.ClientFD)
+	if conn.UpstreamFD != 0 {
+		w.poller.Remove(conn.UpstreamFD)
+		w.socket.CloseSocket(conn.UpstreamFD)
 	}
-
-	return nil
-}
-
-func (s *Server) cleanupConnection(fd int) {
-    conn, exists := s.connections[fd]
-    if !exists {
-        logger.Error("Connection not found in cleanupConnection", "fd", fd)
-        return
-    }
-
-    if conn.Closed {
-        return // Already cleaning up!
-    }
-    conn.Closed = true
-
-    // Now remove both sides from the map and close both fds
-    delete(s.connections, conn.ClientFD)
-    if conn.UpstreamFD != 0 {
-        delete(s.connections, conn.UpstreamFD)
-    }
-
-    s.epoll.Remove(conn.ClientFD)
-    s.socket.CloseSocket(conn.ClientFD)
-    if conn.UpstreamFD != 0 {
-        s.epoll.Remove(conn.UpstreamFD)
-        s.socket.CloseSocket(conn.UpstreamFD)
-    }
-    logger.Info("Connection terminated", "client_fd", conn.ClientFD, "upstream_fd", conn.UpstreamFD)
+	logger.Info("Connection terminated", "client_fd", conn.ClientFD, "upstream_fd", conn.UpstreamFD)
 }
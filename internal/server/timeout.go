@@ -0,0 +1,75 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/stanleydv12/ginx/internal/connection"
+	"github.com/stanleydv12/ginx/internal/parser"
+	"github.com/stanleydv12/ginx/pkg/logger"
+)
+
+// setTimeout (re)arms the connection's timer for the given phase. Every phase
+// except the client header measures a single wait, so it is pushed back each
+// time the connection has to wait again; the client header timeout covers
+// the whole header and keeps its original deadline.
+func (w *worker) setTimeout(conn *connection.Connection, phase connection.TimeoutPhase) {
+	if phase == connection.TimeoutClientHeader && conn.Timeout == phase {
+		return
+	}
+
+	conn.Timeout = phase
+	w.timers.Schedule(conn.ClientFD, time.Now().Add(w.timeoutDuration(phase)))
+}
+
+func (w *worker) timeoutDuration(phase connection.TimeoutPhase) time.Duration {
+	timeouts := w.config.Server.Timeouts
+	switch phase {
+	case connection.TimeoutKeepAlive:
+		return w.config.Server.KeepAliveTimeout
+	case connection.TimeoutClientHeader:
+		return timeouts.ClientHeader
+	case connection.TimeoutClientBody:
+		return timeouts.ClientBody
+	case connection.TimeoutUpstreamConnect:
+		return timeouts.UpstreamConnect
+	case connection.TimeoutUpstreamRead:
+		return timeouts.UpstreamRead
+	default:
+		return timeouts.Send
+	}
+}
+
+// handleTimeout handles the expiry of the timer of the client connection fd.
+func (w *worker) handleTimeout(fd int) {
+	conn, exists := w.connections[fd]
+	if !exists || conn.ClientFD != fd {
+		return
+	}
+
+	logger.Debug("Connection timed out", "client_fd", fd, "state", conn.State, "phase", conn.Timeout)
+
+	switch conn.Timeout {
+	case connection.TimeoutKeepAlive:
+		w.cleanupConnection(fd)
+	case connection.TimeoutClientHeader:
+		// A client that never sent anything gets no response, as for an
+		// idle keep-alive connection.
+		if conn.RequestParser == nil || (len(conn.RequestParser.Header()) == 0 && len(conn.ReadBuffer) == 0) {
+			w.cleanupConnection(fd)
+			return
+		}
+		w.failRequest(conn, withStatus(parser.HTTPStatusCodeRequestTimeout, errors.New("timed out reading request header")))
+	case connection.TimeoutClientBody:
+		w.failRequest(conn, withStatus(parser.HTTPStatusCodeRequestTimeout, errors.New("timed out reading request body")))
+	case connection.TimeoutUpstreamConnect:
+		w.failRequest(conn, upstreamFailure(parser.HTTPStatusCodeGatewayTimeout, errors.New("timed out connecting to upstream")))
+	case connection.TimeoutUpstreamRead:
+		w.failRequest(conn, upstreamFailure(parser.HTTPStatusCodeGatewayTimeout, errors.New("timed out reading upstream response")))
+	default:
+		logger.Error("Timed out sending data", "client_fd", fd, "state", conn.State)
+		w.cleanupConnection(fd)
+	}
+}
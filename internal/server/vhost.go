@@ -0,0 +1,97 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/stanleydv12/ginx/internal/config"
+	"github.com/stanleydv12/ginx/internal/entity"
+	"github.com/stanleydv12/ginx/internal/parser"
+	"github.com/stanleydv12/ginx/internal/router"
+	"github.com/stanleydv12/ginx/pkg/logger"
+)
+
+// VirtualHost is a configured virtual host together with the router of its
+// locations.
+type VirtualHost struct {
+	Config config.VirtualHostConfig
+	Router router.RouterHandler
+}
+
+// route picks the upstream group for req from the locations of vhost,
+// rewriting req.Path as the matched location says. Requests that match no
+// location go to the virtual host's upstream, and are not found if it has
+// none. A path that cannot be normalized is a bad request.
+func route(vhost *VirtualHost, req *entity.HTTPRequest) (string, error) {
+	upstream := vhost.Config.Upstream
+	route, matched, err := vhost.Router.Route(req.Path)
+	if err != nil {
+		return "", withStatus(parser.HTTPStatusCodeBadRequest, err)
+	}
+	if matched {
+		logger.Debug("Request routed", "location", route.Location.Path, "upstream", route.Location.Upstream, "path", req.Path, "upstream_path", route.Path)
+		req.Path = route.Path
+		if route.Location.Upstream != "" {
+			upstream = route.Location.Upstream
+		}
+	}
+
+	if upstream == "" {
+		return "", withStatus(parser.HTTPStatusCodeNotFound, errors.New("no location matches the request"))
+	}
+	return upstream, nil
+}
+
+// virtualHost picks the virtual host of l that serves requests for host, the
+// value of their Host header. As in nginx, an exact server name wins over the
+// longest matching "*.example.com", which wins over the longest matching
+// "www.example.*"; requests that match none go to the default virtual host.
+func (l *listener) virtualHost(host string) *VirtualHost {
+	host = normalizeHost(host)
+	if host == "" {
+		return l.defaultHost
+	}
+
+	var leading, trailing *VirtualHost
+	leadingLength, trailingLength := 0, 0
+	for _, vhost := range l.virtualHosts {
+		for _, name := range vhost.Config.ServerName {
+			name = strings.ToLower(name)
+			switch {
+			case name == host:
+				return vhost
+			case strings.HasPrefix(name, "*.") && strings.HasSuffix(host, name[1:]):
+				if len(name) > leadingLength {
+					leading, leadingLength = vhost, len(name)
+				}
+			case strings.HasSuffix(name, ".*") && strings.HasPrefix(host, name[:len(name)-1]):
+				if len(name) > trailingLength {
+					trailing, trailingLength = vhost, len(name)
+				}
+			}
+		}
+	}
+
+	switch {
+	case leading != nil:
+		return leading
+	case trailing != nil:
+		return trailing
+	default:
+		return l.defaultHost
+	}
+}
+
+// normalizeHost strips the port and any trailing dot from a Host header value
+// and lowercases it.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
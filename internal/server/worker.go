@@ -0,0 +1,174 @@
+//go:build linux
+
+package server
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/stanleydv12/ginx/internal/async"
+	"github.com/stanleydv12/ginx/internal/connection"
+	"github.com/stanleydv12/ginx/internal/pool"
+	"github.com/stanleydv12/ginx/internal/timer"
+	"github.com/stanleydv12/ginx/pkg/logger"
+
+	"golang.org/x/sys/unix"
+)
+
+// worker is a single event loop. Each has its own SO_REUSEPORT socket on every
+// TCP listener, so the kernel spreads new connections across them, and its
+// own poller, timers, upstream pools and connection map, so a connection is
+// only ever touched by one goroutine. Unix socket listeners are the exception,
+// with one socket that all workers accept from. The load balancers, health
+// checkers and retry budget are shared by all workers and guard their state
+// with their own locks.
+type worker struct {
+	*Server
+
+	id int
+	// listenFds maps the worker's listening fds to the index of their
+	// listener in the server.
+	listenFds map[int]int
+	poller    async.Poller
+	// pools holds the idle upstream connections of each upstream group.
+	pools       map[string]pool.ConnectionPool
+	timers      timer.TimerHandler
+	connections map[int]*connection.Connection
+}
+
+func newWorker(server *Server, id int) (*worker, error) {
+	poller, err := async.NewPoller(server.config.Server.AsyncMethod, server.config.Server.MaxOpenFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return &worker{
+		Server:      server,
+		id:          id,
+		listenFds:   make(map[int]int),
+		poller:      poller,
+		pools:       newPools(server),
+		timers:      timer.NewTimerHeap(),
+		connections: make(map[int]*connection.Connection),
+	}, nil
+}
+
+// newPools creates a connection pool for every upstream group, sized by the
+// group's upstream_pool settings.
+func newPools(server *Server) map[string]pool.ConnectionPool {
+	pools := make(map[string]pool.ConnectionPool, len(server.config.Server.Upstreams))
+	for name, group := range server.config.Server.Upstreams {
+		pools[name] = pool.NewUpstreamPool(server.socket, group.UpstreamPool.MaxIdle, group.UpstreamPool.IdleTimeout)
+	}
+	return pools
+}
+
+// listen gives the worker a socket on every listener. TCP listeners of
+// several workers share their address through SO_REUSEPORT; a Unix socket path
+// can only be bound once, so workers all accept from the server's socket.
+func (w *worker) listen(reusePort bool) error {
+	for i, l := range w.listeners {
+		fd := l.sharedFd
+		if fd == 0 {
+			var err error
+			if fd, err = w.bindListener(l.config, reusePort); err != nil {
+				return err
+			}
+		}
+		w.listenFds[fd] = i
+
+		// A shared socket is polled by every worker, so have each
+		// connection wake only one of them.
+		events := uint32(unix.EPOLLIN)
+		if fd == l.sharedFd {
+			events |= unix.EPOLLEXCLUSIVE
+		}
+		if err := w.poller.Add(fd, events); err != nil {
+			logger.Error("Failed to add socket to poller", "error", err)
+			return err
+		}
+
+		logger.Debug("Worker listening", "worker", w.id, "fd", fd, "address", listenAddress(l.config))
+	}
+	return nil
+}
+
+// run is the worker's event loop. It returns nil once the server is stopped.
+func (w *worker) run() error {
+	defer w.stop()
+
+	if w.config.Server.WorkerCPUAffinity {
+		w.pinToCPU()
+	}
+
+	lastSweep := time.Now()
+	for !w.stopping.Load() {
+		// Sleep until the next connection timeout is due, but wake up
+		// periodically to sweep the upstream pool.
+		timeout := w.timers.Timeout(time.Now())
+		if sweep := int(idleSweepInterval / time.Millisecond); timeout < 0 || timeout > sweep {
+			timeout = sweep
+		}
+
+		events, err := w.poller.Wait(timeout)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			logger.Error("Failed to wait for events", "worker", w.id, "error", err)
+			return err
+		}
+
+		for _, event := range events {
+			w.handleEvent(event)
+		}
+
+		for _, fd := range w.timers.Expired(time.Now()) {
+			w.handleTimeout(fd)
+		}
+
+		if time.Since(lastSweep) >= idleSweepInterval {
+			for _, upstreamPool := range w.pools {
+				upstreamPool.EvictExpired()
+			}
+			lastSweep = time.Now()
+		}
+	}
+	return nil
+}
+
+// pinToCPU locks the worker's goroutine to an OS thread and binds that thread
+// to one CPU, assigning CPUs to workers round-robin.
+func (w *worker) pinToCPU() {
+	runtime.LockOSThread()
+
+	var set unix.CPUSet
+	set.Set(w.id % runtime.NumCPU())
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		logger.Error("Failed to set worker CPU affinity", "worker", w.id, "error", err)
+		return
+	}
+	logger.Debug("Worker pinned to CPU", "worker", w.id, "cpu", w.id%runtime.NumCPU())
+}
+
+func (w *worker) stop() {
+	for fd, i := range w.listenFds {
+		if err := w.poller.Remove(fd); err != nil {
+			logger.Error("Failed to remove socket from poller", "error", err)
+		}
+
+		if fd != w.listeners[i].sharedFd {
+			if err := w.socket.CloseSocket(fd); err != nil {
+				logger.Error("Failed to close socket", "error", err)
+			}
+		}
+	}
+
+	for _, upstreamPool := range w.pools {
+		upstreamPool.Close()
+	}
+
+	if err := w.poller.Close(); err != nil {
+		logger.Error("Failed to close poller", "worker", w.id, "error", err)
+	}
+}
@@ -7,12 +7,14 @@ import (
 	"github.com/stanleydv12/ginx/pkg/logger"
 
 	"net"
+	"net/netip"
 	"fmt"
 	"golang.org/x/sys/unix"
+	"strconv"
 )
 
 const (
-	domain   = unix.AF_INET     // IPv4
+	domain   = unix.AF_INET     // IPv4, unless the options ask for another
 	tcpType  = unix.SOCK_STREAM // TCP
 	udpType  = unix.SOCK_DGRAM  // UDP
 	protocol = 0                // Default protocol
@@ -35,7 +37,12 @@ func (s *LinuxSocketManager) CreateSocket(options *socket.SocketOptions) (fd int
 		}
 	}
 
-	fd, err = unix.Socket(domain, opts.Type, protocol)
+	family := opts.Domain
+	if family == 0 {
+		family = domain
+	}
+
+	fd, err = unix.Socket(family, opts.Type, protocol)
 	if err != nil {
 		logger.Error("Failed to create socket", "error", err)
 		return fd, err
@@ -61,6 +68,26 @@ func (s *LinuxSocketManager) CreateSocket(options *socket.SocketOptions) (fd int
 		}
 	}
 
+	if opts.ReusePort {
+		if err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			logger.Error("Failed to set socket to reuse port", "error", err)
+			return fd, err
+		}
+	}
+
+	// Set explicitly rather than left to net.ipv6.bindv6only, so a listener
+	// on :: behaves the same on every host.
+	if family == unix.AF_INET6 {
+		v6only := 0
+		if opts.V6Only {
+			v6only = 1
+		}
+		if err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, v6only); err != nil {
+			logger.Error("Failed to set IPV6_V6ONLY", "error", err)
+			return fd, err
+		}
+	}
+
 	return fd, nil
 }
 
@@ -72,105 +99,100 @@ func (s *LinuxSocketManager) CloseSocket(fd int) error {
 }
 
 func (s *LinuxSocketManager) BindSocket(fd int, address string, port int) error {
-	var ip net.IP
 	if address == "" {
-		ip = net.IPv4zero
-	} else {
-		ip = net.ParseIP(address)
-		if ip == nil {
-			return fmt.Errorf("Invalid IP address: %s", address)
-		}
+		address = net.IPv4zero.String()
 	}
 
-	var addr [4]byte
-	copy(addr[:], ip)
+	sa, _, err := sockaddr(address, port)
+	if err != nil {
+		return err
+	}
 
-	if err := unix.Bind(fd, &unix.SockaddrInet4{
-		Port: port,
-		Addr: addr,
-	}); err != nil {
+	if err := unix.Bind(fd, sa); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (s *LinuxSocketManager) StartListening(fd int) error {
-	if err := unix.Listen(fd, 128); err != nil {
-		return err
+// sockaddr builds the socket address of an IP address and port, or of a
+// "unix:" path, along with the address family it belongs to. IPv4-mapped IPv6
+// addresses are taken as IPv4, and an IPv6 zone may name an interface or give
+// its index.
+func sockaddr(address string, port int) (unix.Sockaddr, int, error) {
+	if path, ok := socket.UnixPath(address); ok {
+		if path == "" {
+			return nil, 0, fmt.Errorf("missing path in unix socket address: %s", address)
+		}
+		return &unix.SockaddrUnix{Name: path}, unix.AF_UNIX, nil
 	}
-	return nil
-}
 
-func (s *LinuxSocketManager) AcceptConnection(fd int) (int, error) {
-	connFd, _, err := unix.Accept(fd)
+	addr, err := netip.ParseAddr(address)
 	if err != nil {
-		return -1, err
+		return nil, 0, fmt.Errorf("invalid IP address: %s", address)
 	}
 
-	if err := unix.SetNonblock(connFd, true); err != nil {
-		return -1, err
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return &unix.SockaddrInet4{Port: port, Addr: addr.As4()}, unix.AF_INET, nil
 	}
-	return connFd, nil
-}
 
-func (s *LinuxSocketManager) ReadFromSocket(fd int, buf []byte) (int, error) {
-	return unix.Read(fd, buf)
+	sa := &unix.SockaddrInet6{Port: port, Addr: addr.As16()}
+	if zone := addr.Zone(); zone != "" {
+		if index, err := strconv.Atoi(zone); err == nil {
+			sa.ZoneId = uint32(index)
+		} else if iface, err := net.InterfaceByName(zone); err == nil {
+			sa.ZoneId = uint32(iface.Index)
+		} else {
+			return nil, 0, fmt.Errorf("invalid zone in IP address %s: %v", address, err)
+		}
+	}
+	return sa, unix.AF_INET6, nil
 }
 
-func (s *LinuxSocketManager) WriteToSocket(fd int, buf []byte) (int, error) {
-	return unix.Write(fd, buf)
+func (s *LinuxSocketManager) StartListening(fd int) error {
+	if err := unix.Listen(fd, 128); err != nil {
+		return err
+	}
+	return nil
 }
 
-func (s *LinuxSocketManager) ConnectToSocket(address string, port int) (int, error) {
-	fd, err := s.CreateSocket(nil)
+func (s *LinuxSocketManager) CreateClientSocket(address string, port int) (int, unix.Sockaddr, error) {
+	socketAddr, family, err := sockaddr(address, port)
 	if err != nil {
-		logger.Error("Failed to create socket", "error", err)
-		return -1, err
+		return -1, nil, err
 	}
 
-	if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1); err != nil {
-		logger.Error("Failed to set TCP_NODELAY", "error", err)
-		return -1, err
-	}
-
-	tv := unix.Timeval{Sec: 5}
-	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_SNDTIMEO, &tv); err != nil {
-		s.CloseSocket(fd)
-		return -1, fmt.Errorf("failed to set send timeout: %v", err)
+	fd, err := s.CreateSocket(&socket.SocketOptions{
+		NonBlocking: true,
+		ReuseAddr:   true,
+		Type:        tcpType,
+		Domain:      family,
+	})
+	if err != nil {
+		logger.Error("Failed to create socket", "error", err)
+		return -1, nil, err
 	}
 
-	var socketAddr unix.SockaddrInet4
-	ip := net.ParseIP(address)
-    if ip == nil {
-        s.CloseSocket(fd)
-        return -1, fmt.Errorf("invalid IP address: %s", address)
-    }
-    copy(socketAddr.Addr[:], ip.To4())
-    socketAddr.Port = port
-
-	if err := unix.Connect(fd, &socketAddr); err != nil && err != unix.EINPROGRESS {
-		logger.Error("Failed to connect to socket", "error", err)
-		s.CloseSocket(fd)
-		return -1, err
+	if family != unix.AF_UNIX {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1); err != nil {
+			logger.Error("Failed to set TCP_NODELAY", "error", err)
+			s.CloseSocket(fd)
+			return -1, nil, err
+		}
 	}
 
-	return fd, nil
+	return fd, socketAddr, nil
 }
 
-func (s *LinuxSocketManager) CheckSocketState(fd int) error {
-	errno, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
-    if err != nil {
-        logger.Error("Failed to get socket error status", "error", err)
-        return nil
-    }
-    if errno != 0 {
-        errMsg := unix.Errno(errno).Error()
-        logger.Error("Socket error", 
-            "error_code", errno,
-            "error_message", errMsg,
-            "fd", fd)
-        return nil
-    }
-    return nil
+func (s *LinuxSocketManager) IsSocketAlive(fd int) bool {
+	var buf [1]byte
+	_, _, err := unix.Recvfrom(fd, buf[:], unix.MSG_PEEK|unix.MSG_DONTWAIT)
+	if err != nil {
+		// Nothing to read is exactly what an idle connection looks like.
+		return err == unix.EAGAIN || err == unix.EWOULDBLOCK
+	}
+	// A successful read means either EOF (the peer closed the connection) or
+	// data we never asked for that would corrupt the next response.
+	return false
 }
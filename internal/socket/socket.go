@@ -1,20 +1,99 @@
 //go:build linux
 package socket
 
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// SocketError is a pending error reported by the kernel for a socket, such as
+// the outcome of a failed non-blocking connect.
+type SocketError struct {
+	FD  int
+	Err error
+}
+
+func (e *SocketError) Error() string {
+	return fmt.Sprintf("socket %d: %v", e.FD, e.Err)
+}
+
+func (e *SocketError) Unwrap() error {
+	return e.Err
+}
+
 type SocketOptions struct {
 	NonBlocking bool
 	ReuseAddr   bool
-	Type        int
+	// ReusePort lets several sockets bind the same address, with the kernel
+	// spreading incoming connections across them.
+	ReusePort bool
+	Type      int
+	// Domain is the address family, AF_INET when zero.
+	Domain int
+	// V6Only keeps an AF_INET6 socket to IPv6. Without it, a socket bound
+	// to :: accepts IPv4 connections too.
+	V6Only bool
+}
+
+// UnixPrefix marks an address as the path of a Unix domain socket, as in
+// "unix:/run/app.sock".
+const UnixPrefix = "unix:"
+
+// UnixPath returns the socket path of a "unix:" address.
+func UnixPath(address string) (string, bool) {
+	return strings.CutPrefix(address, UnixPrefix)
+}
+
+// Domain returns the address family of a socket bound or connected to
+// address: AF_UNIX for "unix:" addresses, AF_INET6 for IPv6 addresses and
+// AF_INET for anything else.
+func Domain(address string) int {
+	if _, ok := UnixPath(address); ok {
+		return unix.AF_UNIX
+	}
+	if addr, err := netip.ParseAddr(address); err == nil && !addr.Unmap().Is4() {
+		return unix.AF_INET6
+	}
+	return unix.AF_INET
+}
+
+// SockaddrString formats a peer address as host:port, or as a "unix:" address.
+func SockaddrString(sa unix.Sockaddr) string {
+	switch addr := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.JoinHostPort(net.IP(addr.Addr[:]).String(), strconv.Itoa(addr.Port))
+	case *unix.SockaddrInet6:
+		return net.JoinHostPort(net.IP(addr.Addr[:]).String(), strconv.Itoa(addr.Port))
+	case *unix.SockaddrUnix:
+		// Clients of a Unix socket are almost always unnamed, which
+		// x/sys/unix reports as "@".
+		if addr.Name == "@" {
+			return UnixPrefix
+		}
+		return UnixPrefix + addr.Name
+	default:
+		return ""
+	}
 }
 
 type SocketManager interface {
 	CreateSocket(options *SocketOptions) (fd int, err error)
 	CloseSocket(fd int) error
+	// BindSocket binds fd to an IP address and port, or to the path of a
+	// "unix:" address, in which case port is ignored.
 	BindSocket(fd int, address string, port int) error
 	StartListening(fd int) error
-	AcceptConnection(fd int) (int, error)
-	ReadFromSocket(fd int, buf []byte) (int, error)
-	WriteToSocket(fd int, buf []byte) (int, error)
-	ConnectToSocket(address string, port int) (int, error)
-	CheckSocketState(fd int) error
+	// CreateClientSocket creates a non-blocking socket for connecting to an
+	// IP address and port, or to the path of a "unix:" address, and returns
+	// it with the address to connect it to. Accepting, connecting, reading
+	// and writing are left to the event loop's poller.
+	CreateClientSocket(address string, port int) (int, unix.Sockaddr, error)
+	// IsSocketAlive reports whether an idle connected socket is still usable,
+	// i.e. the peer has neither closed it nor sent unsolicited data.
+	IsSocketAlive(fd int) bool
 }
\ No newline at end of file
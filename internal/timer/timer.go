@@ -0,0 +1,112 @@
+//go:build linux
+
+package timer
+
+import (
+	"container/heap"
+	"time"
+)
+
+type TimerHandler interface {
+	// Schedule sets the deadline of the timer with the given id, replacing
+	// any deadline it already had.
+	Schedule(id int, deadline time.Time)
+	// Cancel removes the timer with the given id, if any.
+	Cancel(id int)
+	// Timeout returns how many milliseconds remain until the earliest
+	// deadline, rounded up, or -1 if no timer is scheduled. It is meant to be
+	// passed straight to Poller.Wait.
+	Timeout(now time.Time) int
+	// Expired removes and returns the ids of every timer whose deadline is
+	// not after now, earliest first.
+	Expired(now time.Time) []int
+}
+
+type timerEntry struct {
+	id       int
+	deadline time.Time
+	index    int
+}
+
+// TimerHeap is a min-heap of deadlines keyed by id, so the event loop can
+// sleep exactly until the next one and find expired timers without scanning
+// every connection.
+type TimerHeap struct {
+	entries timerEntries
+	byID    map[int]*timerEntry
+}
+
+func NewTimerHeap() TimerHandler {
+	return &TimerHeap{
+		byID: make(map[int]*timerEntry),
+	}
+}
+
+func (t *TimerHeap) Schedule(id int, deadline time.Time) {
+	if entry, ok := t.byID[id]; ok {
+		entry.deadline = deadline
+		heap.Fix(&t.entries, entry.index)
+		return
+	}
+
+	entry := &timerEntry{id: id, deadline: deadline}
+	heap.Push(&t.entries, entry)
+	t.byID[id] = entry
+}
+
+func (t *TimerHeap) Cancel(id int) {
+	entry, ok := t.byID[id]
+	if !ok {
+		return
+	}
+	heap.Remove(&t.entries, entry.index)
+	delete(t.byID, id)
+}
+
+func (t *TimerHeap) Timeout(now time.Time) int {
+	if len(t.entries) == 0 {
+		return -1
+	}
+	remaining := t.entries[0].deadline.Sub(now)
+	if remaining <= 0 {
+		return 0
+	}
+	return int((remaining + time.Millisecond - 1) / time.Millisecond)
+}
+
+func (t *TimerHeap) Expired(now time.Time) []int {
+	var ids []int
+	for len(t.entries) > 0 && !t.entries[0].deadline.After(now) {
+		entry := heap.Pop(&t.entries).(*timerEntry)
+		delete(t.byID, entry.id)
+		ids = append(ids, entry.id)
+	}
+	return ids
+}
+
+// timerEntries implements heap.Interface ordered by deadline.
+type timerEntries []*timerEntry
+
+func (e timerEntries) Len() int { return len(e) }
+
+func (e timerEntries) Less(i, j int) bool { return e[i].deadline.Before(e[j].deadline) }
+
+func (e timerEntries) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+	e[i].index = i
+	e[j].index = j
+}
+
+func (e *timerEntries) Push(x any) {
+	entry := x.(*timerEntry)
+	entry.index = len(*e)
+	*e = append(*e, entry)
+}
+
+func (e *timerEntries) Pop() any {
+	old := *e
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*e = old[:len(old)-1]
+	return entry
+}